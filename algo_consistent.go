@@ -1,21 +1,17 @@
 package balance
 
 import (
-	"hash/crc32"
 	"math"
-	"os"
-	"path/filepath"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
-	defaultReplicationCount = 256
+	defaultDrainTimeout = 30 * time.Second
 )
 
 // ConsistentConfig holds the configuration for the Consistent hash algorithm.
@@ -23,162 +19,519 @@ type ConsistentConfig struct {
 	// Name used for metrics and reporting
 	Name string
 
+	// Layout is the ring layout, controlling how virtual nodes are named and the
+	// defaults for Hash and ReplicationCount. Changing the layout changes where
+	// keys are placed on the ring.
+	// Defaults to DefaultRingLayout.
+	Layout RingLayout
+
 	// Hash is the hashing function used for hash Endpoints and keys onto the hash
-	// ring. You may want to use an interesting hash function like xxHash.
-	// Defaults to CRC32.
+	// ring. You may want to use an interesting hash function like xxHash, see
+	// HashName.
+	// Defaults to the hash function of the ring layout, CRC32 for all layouts.
 	Hash Hash
 
+	// Hash64 is a 64-bit hashing function. It takes precedence over Hash.
+	Hash64 Hash64
+
+	// HashName selects one of the built-in hash functions by name, see
+	// HashNames. Hash and Hash64 take precedence over HashName.
+	HashName string
+
 	// ReplicationCount controls the number of virtual nodes to add to the hash
-	// ring for each Endpoint.
-	// Defaults to 128.
+	// ring for each Endpoint of weight DefaultWeight. Endpoints implementing
+	// Weighted have a number of virtual nodes proportional to their weight, at
+	// least one. Bounded loads don't take weights into account.
+	// Defaults to the number of virtual nodes of the ring layout, 256 for all
+	// layouts.
 	ReplicationCount int
 
 	// LoadFactor controls the maximum load of any endpoint. The load is defined as
 	// the number of requests currently being handled by an endpoint. When set to a
 	// value > 1.0, Consistent implements the bounded loads variant of consistent
-	// hashing and ensures no endpoint has a load > LoadFactor * averageLoad.
+	// hashing and ensures no endpoint has a load > LoadFactor * averageLoad,
+	// within the tolerance described in GetExcluding for concurrent calls.
 	//
 	// See https://arxiv.org/abs/1608.01350 for details about consistent hashing
 	// with bounded loads.
 	LoadFactor float64
+
+	// LoadModel controls how the load of endpoints is measured with bounded
+	// loads.
+	// Defaults to LoadInFlight.
+	LoadModel LoadModel
+
+	// LoadHalfLife is the half-life of the decayed request rate used as load
+	// with LoadRate.
+	// Defaults to 1s.
+	LoadHalfLife time.Duration
+
+	// HotKeys configures the detection of hot keys. Requests for hot keys are
+	// spread across HotKeys.Spread Endpoints. Disabled by default.
+	HotKeys HotKeyConfig
+
+	// DrainTimeout is the maximum time a removed Endpoint is kept around while
+	// draining. Removed Endpoints don't receive new requests but their in-flight
+	// requests are still accounted for until they are released with Put or the
+	// timeout expires.
+	// Defaults to 30s.
+	DrainTimeout time.Duration
+
+	// NotReady controls where requests for the keys of Endpoints that aren't
+	// ready, see Readiness, are sent.
+	// Defaults to NotReadyNext.
+	NotReady NotReadyPolicy
+
+	// Metrics configures where metrics are registered and the per-endpoint
+	// series.
+	Metrics MetricsConfig
+
+	// OnRemap, if set, is called after each change of the Endpoints or of
+	// their weights with a report of how keys moved between Endpoints. It's
+	// called synchronously, from AddEndpoints, RemoveEndpoints and
+	// UpdateWeights.
+	OnRemap func(report RemapReport)
+}
+
+// NotReadyPolicy is how Consistent handles Endpoints that aren't ready.
+type NotReadyPolicy int
+
+const (
+	// NotReadyNext sends requests for the keys of a not ready Endpoint to the
+	// next ready Endpoint on the ring. Not ready Endpoints keep their place on
+	// the ring so keys go back to them once they are ready. When no Endpoint is
+	// ready, readiness is ignored.
+	NotReadyNext NotReadyPolicy = iota
+	// NotReadyIgnore sends requests to Endpoints whether they are ready or not.
+	NotReadyIgnore
+)
+
+// RemapReport describes how the key space moved between Endpoints after a
+// change of the Endpoints. Fractions are fractions of the hash space, ie. the
+// expected share of keys.
+//
+// Changes from or to an empty ring aren't reported.
+type RemapReport struct {
+	// Moved is the fraction of the key space now mapped to a different
+	// Endpoint.
+	Moved float64
+
+	// Moves holds the fraction of the key space that moved from an Endpoint to
+	// another, indexed by Endpoint key: Moves[from][to].
+	Moves map[string]map[string]float64
 }
 
 // Store per-endpoint information.
 type endpointInfo struct {
 	endpoint Endpoint
-	load     int
+	replicas int   // Number of virtual nodes
+	load     int64 // Number of requests in flight, atomic.
+	// overflows is the number of requests for keys mapped to the endpoint sent
+	// to another endpoint because it was overloaded, atomic.
+	overflows int64
+	// rate is the decayed request rate of the endpoint with LoadRate.
+	rate *decayedRate
+	// drainTimer is set when the endpoint has been removed and is waiting for
+	// its in-flight requests to finish.
+	drainTimer *time.Timer
+	// metrics is nil unless per-endpoint metrics are enabled.
+	metrics *endpointMetrics
 }
 
 // Consistent implements a consistent hashing algorithm.
+//
+// Endpoint changes take the write lock. In bounded-load mode, Get and Put only
+// take the read lock and update loads with atomic operations.
 type Consistent struct {
-	sync.Mutex
-	name         string
-	hash         Hash
-	replicas     int
-	numEndpoints int
-	loadFactor   float64
-	totalLoad    int                   // Total number of requests in flight.
-	keys         []int                 // Sorted
-	endpoints    map[int]*endpointInfo // hash(Endpoint.Key()) -> endpointInfo
+	sync.RWMutex
+	name           string
+	layout         RingLayout
+	hash           Hash64
+	hashBits       uint // Width of the hash values
+	replicas       int
+	numEndpoints   int
+	loadFactor     float64
+	loadModel      LoadModel
+	notReady       NotReadyPolicy
+	loadHalfLife   time.Duration
+	now            func() time.Time
+	hotKeys        *hotKeyDetector
+	drainTimeout   time.Duration
+	onRemap        func(report RemapReport)
+	metricsConfig  MetricsConfig
+	vecs           *metricVecs
+	metrics        consistentMetrics
+	endpointSeries int                      // Number of Endpoints with their own per-endpoint series.
+	totalLoad      int64                    // Total number of requests in flight, atomic.
+	totalRate      decayedRate              // Total decayed request rate with LoadRate.
+	drainingLoad   int64                    // Number of requests in flight on draining endpoints.
+	ring           atomic.Value             // *ring, replaced on each Endpoint change
+	endpoints      map[string]*endpointInfo // Endpoint.Key() -> endpointInfo
+	draining       map[string]*endpointInfo // Endpoint.Key() -> endpointInfo
 }
 
 var _ Algorithm = &Consistent{}
 var _ EndpointSet = &Consistent{}
+var _ ErrorReporter = &Consistent{}
+var _ WeightUpdater = &Consistent{}
+
+// consistentMetrics holds the metrics of a Consistent object. They are bound to
+// its name once to keep label lookups out of Get and Put.
+type consistentMetrics struct {
+	inflight      prometheus.Gauge
+	endpoints     prometheus.Gauge
+	requests      prometheus.Counter
+	overflowed    prometheus.Counter
+	hot           prometheus.Counter
+	draining      prometheus.Gauge
+	drainTimeouts prometheus.Counter
+
+	ownershipPeakToMean prometheus.Gauge
+	remapped            prometheus.Observer
+}
 
-// Prometheus metrics
-var (
-	// use program name as prefix for metrics
-	filename = strings.ReplaceAll(filepath.Base(os.Args[0]), ".", "_")
-
-	totalLoadGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: filename,
-		Name:      "lb_requests_inflight",
-		Help:      "Total number of requests in-flight.",
-	}, []string{"name"})
-	numEndpointsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: filename,
-		Name:      "lb_endpoints",
-		Help:      "Number of endpoints for this service.",
-	}, []string{"name"})
-	requestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-		Namespace: filename,
-		Name:      "lb_requests_total",
-		Help:      "Number of processed requests.",
-	}, []string{"name"})
-	requestsOverflowedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-		Namespace: filename,
-		Name:      "lb_requests_overflowed_total",
-		Help:      "Number of requests that overflowed the load factor.",
-	}, []string{"name"})
-)
+func newConsistentMetrics(vecs *metricVecs, name string) consistentMetrics {
+	return consistentMetrics{
+		inflight:      vecs.inflight.WithLabelValues(name),
+		endpoints:     vecs.endpoints.WithLabelValues(name),
+		requests:      vecs.requests.WithLabelValues(name),
+		overflowed:    vecs.overflowed.WithLabelValues(name),
+		hot:           vecs.hot.WithLabelValues(name),
+		draining:      vecs.draining.WithLabelValues(name),
+		drainTimeouts: vecs.drainTimeouts.WithLabelValues(name),
+
+		ownershipPeakToMean: vecs.ownershipPeakToMean.WithLabelValues(name),
+		remapped:            vecs.remapped.WithLabelValues(name),
+	}
+}
 
 // NewConsistent creates a new Consistent object.
 func NewConsistent(config ConsistentConfig) *Consistent {
+	if !config.HotKeys.valid() {
+		return nil
+	}
+	if config.Metrics.MaxEndpointSeries == 0 {
+		config.Metrics.MaxEndpointSeries = defaultMaxEndpointSeries
+	}
+	vecs := newMetricVecs(config.Metrics)
 	c := &Consistent{
-		name:       config.Name,
-		replicas:   config.ReplicationCount,
-		loadFactor: config.LoadFactor,
-		hash:       config.Hash,
-		endpoints:  make(map[int]*endpointInfo),
+		name:          config.Name,
+		layout:        config.Layout,
+		replicas:      config.ReplicationCount,
+		loadFactor:    config.LoadFactor,
+		loadModel:     config.LoadModel,
+		notReady:      config.NotReady,
+		loadHalfLife:  config.LoadHalfLife,
+		now:           time.Now,
+		hash:          config.Hash64,
+		hotKeys:       newHotKeyDetector(config.Name, config.HotKeys, vecs.hotKeyRequests),
+		drainTimeout:  config.DrainTimeout,
+		onRemap:       config.OnRemap,
+		metricsConfig: config.Metrics,
+		vecs:          vecs,
+		metrics:       newConsistentMetrics(vecs, config.Name),
+		endpoints:     make(map[string]*endpointInfo),
+		draining:      make(map[string]*endpointInfo),
 	}
 	// LoadFactor must be > 1.0.
 	if c.loadFactor != 0 && c.loadFactor <= 1.0 {
 		return nil
 	}
+	if c.loadModel != LoadInFlight && c.loadModel != LoadRate {
+		return nil
+	}
+	if c.notReady != NotReadyNext && c.notReady != NotReadyIgnore {
+		return nil
+	}
+	if c.loadHalfLife == 0 {
+		c.loadHalfLife = defaultLoadHalfLife
+	}
+	if c.layout == 0 {
+		c.layout = DefaultRingLayout
+	}
+	if !c.layout.valid() {
+		return nil
+	}
 	if c.replicas == 0 {
-		c.replicas = defaultReplicationCount
+		c.replicas = c.layout.defaultReplicationCount()
+	}
+	c.hashBits = 64
+	if c.hash == nil && config.Hash != nil {
+		c.hash = Hash32To64(config.Hash)
+		c.hashBits = 32
+	}
+	if c.hash == nil && config.HashName != "" {
+		hash, err := HashByName(config.HashName)
+		if err != nil {
+			return nil
+		}
+		c.hash = hash
+		c.hashBits = hashBits(config.HashName)
 	}
 	if c.hash == nil {
-		c.hash = crc32.ChecksumIEEE
+		c.hash = c.layout.defaultHash()
+		c.hashBits = c.layout.defaultHashBits()
 	}
-	numEndpointsGauge.WithLabelValues(c.name).Set(0)
+	if c.drainTimeout == 0 {
+		c.drainTimeout = defaultDrainTimeout
+	}
+	c.ring.Store(emptyRing)
+	c.metrics.endpoints.Set(0)
 	return c
 }
 
-// isEmpty returns true if there are no items available.
-func (c *Consistent) isEmpty() bool {
-	return len(c.keys) == 0
+// snapshot returns the current hash ring.
+func (c *Consistent) snapshot() *ring {
+	return c.ring.Load().(*ring)
 }
 
 // Compute the hash of the ith replica.
-func (c *Consistent) replicaHash(key string, i int) int {
-	return int(c.hash([]byte(strconv.Itoa(i) + key)))
+func (c *Consistent) replicaHash(key string, i int) uint64 {
+	return c.hash(c.layout.virtualNodeName(key, i))
 }
 
 // info returns the endpointInfo structure for the given endpoint key.
 func (c *Consistent) info(key string) *endpointInfo {
-	if info, ok := c.endpoints[c.replicaHash(key, 0)]; ok {
-		return info
+	return c.endpoints[key]
+}
+
+// numReplicas returns the number of virtual nodes of endpoint, given its
+// weight. Weights are clamped to MaxWeight.
+func (c *Consistent) numReplicas(endpoint Endpoint) int {
+	weight := DefaultWeight
+	if weighted, ok := endpoint.(Weighted); ok {
+		weight = clampWeight(weighted.Weight())
 	}
-	return nil
+
+	n := (c.replicas*weight + DefaultWeight/2) / DefaultWeight
+	if n < 1 {
+		n = 1
+	}
+	return n
 }
 
 // AddEndpoints implements EndpointSet
 func (c *Consistent) AddEndpoints(endpoints ...Endpoint) {
 	c.Lock()
 
+	added := make([]virtualNode, 0, len(endpoints)*c.replicas)
+
+	numAdded := 0
+
 	for _, endpoint := range endpoints {
 		key := endpoint.Key()
+		if _, ok := c.endpoints[key]; ok {
+			// Already part of the ring.
+			continue
+		}
+
 		info := &endpointInfo{
 			endpoint: endpoint,
 		}
 
-		for i := 0; i < c.replicas; i++ {
-			hash := c.replicaHash(key, i)
-			c.keys = append(c.keys, hash)
-			c.endpoints[hash] = info
+		// An endpoint coming back while draining keeps its in-flight requests.
+		if draining, ok := c.draining[key]; ok {
+			c.stopDraining(draining)
+			c.drainingLoad -= draining.load
+			atomic.AddInt64(&c.totalLoad, draining.load)
+			info.load = draining.load
+			info.overflows = draining.overflows
+			info.rate = draining.rate
+			info.metrics = draining.metrics
+		} else {
+			info.metrics = c.newEndpointMetrics(key)
+			if c.loadModel == LoadRate {
+				info.rate = &decayedRate{}
+			}
+		}
+
+		// Virtual nodes of different endpoints may have the same hash. They are
+		// all kept on the ring, the endpoint key breaking the tie.
+		info.replicas = c.numReplicas(endpoint)
+		for i := 0; i < info.replicas; i++ {
+			added = append(added, virtualNode{c.replicaHash(key, i), info})
 		}
+		c.endpoints[key] = info
 
 		c.numEndpoints++
+		numAdded++
 	}
 
-	sort.Ints(c.keys)
+	var report *RemapReport
+	if numAdded > 0 {
+		// Only sort the new virtual nodes and merge them into the ring, which is
+		// already sorted.
+		sort.Slice(added, func(i, j int) bool { return added[i].less(added[j]) })
+		old := c.snapshot()
+		c.ring.Store(old.add(added, numAdded))
+		c.updateOwnershipMetrics()
+		report = c.remapReport(old)
+	}
 
 	c.Unlock()
-	numEndpointsGauge.WithLabelValues(c.name).Set(float64(c.numEndpoints))
+	c.updateEndpointsMetrics()
+	c.reportRemap(report)
 }
 
-func deleteFromSlice(s []int, hash int) []int {
-	var i int
+// remapReport compares old to the current ring. It returns nil if one of them
+// is empty. Must be called with the lock held.
+func (c *Consistent) remapReport(old *ring) *RemapReport {
+	r := c.snapshot()
+	if old.isEmpty() || r.isEmpty() {
+		return nil
+	}
 
-	for i = range s {
-		if s[i] == hash {
-			break
+	report := &RemapReport{
+		Moves: make(map[string]map[string]float64),
+	}
+	old.remapped(r, c.hashBits, func(from, to *endpointInfo, fraction float64) {
+		fromKey := from.endpoint.Key()
+		if report.Moves[fromKey] == nil {
+			report.Moves[fromKey] = make(map[string]float64)
 		}
+		report.Moves[fromKey][to.endpoint.Key()] += fraction
+		report.Moved += fraction
+	})
+	return report
+}
+
+// reportRemap publishes a report computed by remapReport. Must be called
+// without the lock held.
+func (c *Consistent) reportRemap(report *RemapReport) {
+	if report == nil {
+		return
+	}
+	c.metrics.remapped.Observe(report.Moved)
+	if c.onRemap != nil {
+		c.onRemap(*report)
 	}
+}
+
+// newEndpointMetrics returns the per-endpoint series of a new endpoint, or nil
+// if they are disabled. Must be called with the lock held.
+func (c *Consistent) newEndpointMetrics(key string) *endpointMetrics {
+	if !c.metricsConfig.EndpointMetrics {
+		return nil
+	}
+	if c.endpointSeries >= c.metricsConfig.MaxEndpointSeries {
+		m := c.vecs.endpointMetrics(c.name, otherEndpoint)
+		m.shared = true
+		return m
+	}
+	c.endpointSeries++
+	return c.vecs.endpointMetrics(c.name, key)
+}
+
+// deleteEndpointMetrics deletes the per-endpoint series of an endpoint that is
+// gone for good. Must be called with the lock held.
+func (c *Consistent) deleteEndpointMetrics(info *endpointInfo) {
+	m := info.metrics
+	if m == nil || m.shared {
+		return
+	}
+	c.endpointSeries--
+	c.vecs.deleteEndpointMetrics(c.name, m.label)
+}
+
+// updateOwnershipMetrics updates the ring ownership metrics after a ring
+// change. The per-endpoint series are only updated with per-endpoint metrics.
+// Must be called with the lock held.
+func (c *Consistent) updateOwnershipMetrics() {
+	r := c.snapshot()
+	ownership := r.ownership(c.hashBits)
+
+	var peak float64
+	for _, fraction := range ownership {
+		if fraction > peak {
+			peak = fraction
+		}
+	}
+	if r.isEmpty() {
+		c.metrics.ownershipPeakToMean.Set(0)
+	} else {
+		c.metrics.ownershipPeakToMean.Set(peak * float64(r.numEndpoints))
+	}
+
+	if !c.metricsConfig.EndpointMetrics {
+		return
+	}
+
+	var other float64
+	for info, fraction := range ownership {
+		if info.metrics.shared {
+			other += fraction
+			continue
+		}
+		info.metrics.ownership.Set(fraction)
+	}
+	// Endpoints past MaxEndpointSeries share the same series.
+	if other > 0 {
+		c.vecs.endpointOwnership.WithLabelValues(c.name, otherEndpoint).Set(other)
+	} else {
+		c.vecs.endpointOwnership.DeleteLabelValues(c.name, otherEndpoint)
+	}
+	// Draining endpoints don't own any part of the ring.
+	for _, info := range c.draining {
+		if !info.metrics.shared {
+			info.metrics.ownership.Set(0)
+		}
+	}
+}
+
+func (c *Consistent) updateEndpointsMetrics() {
+	c.Lock()
+	numEndpoints, numDraining := c.numEndpoints, len(c.draining)
+	c.Unlock()
+
+	c.metrics.endpoints.Set(float64(numEndpoints))
+	c.metrics.draining.Set(float64(numDraining))
+}
 
-	if i != len(s) {
-		s[i] = s[len(s)-1]
-		s = s[:len(s)-1]
+// drain starts draining a removed endpoint. Must be called with the lock held.
+func (c *Consistent) drain(key string, info *endpointInfo) {
+	if info.load == 0 {
+		c.deleteEndpointMetrics(info)
+		return
 	}
 
-	return s
+	c.drainingLoad += info.load
+	c.draining[key] = info
+	info.drainTimer = time.AfterFunc(c.drainTimeout, func() {
+		c.Lock()
+		if c.draining[key] != info {
+			// The endpoint has finished draining or has been added back.
+			c.Unlock()
+			return
+		}
+		c.stopDraining(info)
+		c.drainingLoad -= info.load
+		load := info.load
+		if info.metrics != nil {
+			info.metrics.inflight.Sub(float64(load))
+		}
+		c.deleteEndpointMetrics(info)
+		c.Unlock()
+
+		c.metrics.inflight.Sub(float64(load))
+		c.metrics.drainTimeouts.Inc()
+		c.updateEndpointsMetrics()
+	})
+}
+
+// stopDraining forgets about a draining endpoint. Must be called with the lock
+// held.
+func (c *Consistent) stopDraining(info *endpointInfo) {
+	info.drainTimer.Stop()
+	delete(c.draining, info.endpoint.Key())
 }
 
 // RemoveEndpoints implements EndpointSet
 func (c *Consistent) RemoveEndpoints(endpoints ...Endpoint) {
 	c.Lock()
 
+	// Collect the endpoints to remove to rebuild the ring in one pass.
+	removed := make(map[*endpointInfo]bool, len(endpoints))
+
 	for _, endpoint := range endpoints {
 		key := endpoint.Key()
 		info := c.info(key)
@@ -186,26 +539,121 @@ func (c *Consistent) RemoveEndpoints(endpoints ...Endpoint) {
 			continue
 		}
 
-		// Update load.
-		c.totalLoad -= info.load
+		// Update load. The endpoint in-flight requests are now accounted for
+		// separately until they finish.
+		atomic.AddInt64(&c.totalLoad, -info.load)
+		c.drain(key, info)
 
-		// XXX: can we do better then O(replicas^2 * endpoints) in the deletion code?
-		for i := 0; i < c.replicas; i++ {
-			hash := c.replicaHash(key, i)
-			c.keys = deleteFromSlice(c.keys, hash)
-			delete(c.endpoints, hash)
-		}
+		removed[info] = true
+		delete(c.endpoints, key)
 
 		c.numEndpoints--
 	}
 
-	sort.Ints(c.keys)
+	var report *RemapReport
+	if len(removed) > 0 {
+		old := c.snapshot()
+		c.ring.Store(old.remove(removed))
+		c.updateOwnershipMetrics()
+		report = c.remapReport(old)
+	}
 
 	c.Unlock()
-	numEndpointsGauge.WithLabelValues(c.name).Set(float64(c.numEndpoints))
+	c.updateEndpointsMetrics()
+	c.reportRemap(report)
 }
 
-func loadOK(totalLoad, numEndpoints, endpointLoad int, factor float64) bool {
+// UpdateWeights implements WeightUpdater.
+//
+// Virtual nodes are added or removed at the end of the sequence of virtual
+// nodes of each Endpoint: only the keys of those virtual nodes move.
+func (c *Consistent) UpdateWeights(endpoints ...Endpoint) {
+	c.Lock()
+
+	var added []virtualNode
+	removed := make(map[*endpointInfo]map[uint64]int)
+
+	for _, endpoint := range endpoints {
+		key := endpoint.Key()
+		info := c.info(key)
+		if info == nil {
+			continue
+		}
+
+		n := c.numReplicas(endpoint)
+		for i := info.replicas; i < n; i++ {
+			added = append(added, virtualNode{c.replicaHash(key, i), info})
+		}
+		if n < info.replicas {
+			hashes := make(map[uint64]int, info.replicas-n)
+			for i := n; i < info.replicas; i++ {
+				hashes[c.replicaHash(key, i)]++
+			}
+			removed[info] = hashes
+		}
+		info.replicas = n
+	}
+
+	if len(added) == 0 && len(removed) == 0 {
+		c.Unlock()
+		return
+	}
+
+	old := c.snapshot()
+	r := old
+	if len(removed) > 0 {
+		r = r.removeNodes(removed)
+	}
+	if len(added) > 0 {
+		sort.Slice(added, func(i, j int) bool { return added[i].less(added[j]) })
+		r = r.add(added, 0)
+	}
+	c.ring.Store(r)
+	c.updateOwnershipMetrics()
+	report := c.remapReport(old)
+
+	c.Unlock()
+	c.reportRemap(report)
+}
+
+// spread returns the ring index to use for a request for the hot key hk. idx
+// is the ring index the key hashes to.
+//
+// The request is directed to one of the first distinct endpoints found
+// walking the ring from idx: the least loaded one with bounded loads, the next
+// one in a round-robin fashion otherwise.
+func (c *Consistent) spread(r *ring, hk *hotKey, idx int) int {
+	n := c.hotKeys.config.Spread
+	if n > r.numEndpoints {
+		n = r.numEndpoints
+	}
+
+	candidates := make([]int, 0, n)
+	seen := make(map[*endpointInfo]bool, n)
+	for i := idx; len(candidates) < n; i = r.next(i) {
+		info := r.nodes[i].info
+		if seen[info] {
+			continue
+		}
+		seen[info] = true
+		candidates = append(candidates, i)
+	}
+
+	if c.loadFactor == 0 {
+		next := atomic.AddUint32(&hk.next, 1)
+		return candidates[int(next)%len(candidates)]
+	}
+
+	best := candidates[0]
+	for _, i := range candidates[1:] {
+		if atomic.LoadInt64(&r.nodes[i].info.load) < atomic.LoadInt64(&r.nodes[best].info.load) {
+			best = i
+		}
+	}
+	return best
+}
+
+func loadOK(totalLoad, numEndpoints, endpointLoad int64, factor float64) bool {
 	// We want to ensure the invariant:
 	//  endpointLoad <= c * averageLoad
 	// -> count the incoming request in the total and endpoint load.
@@ -216,60 +664,184 @@ func loadOK(totalLoad, numEndpoints, endpointLoad int, factor float64) bool {
 	return false
 }
 
+// rateOK is loadOK for the LoadRate model.
+func rateOK(totalRate float64, numEndpoints int64, endpointRate float64, factor float64) bool {
+	averageRate := (totalRate + 1) / float64(numEndpoints)
+	return endpointRate+1 <= math.Ceil(factor*averageRate)
+}
+
+// searchRate returns the ring index of the first endpoint from idx with an
+// acceptable request rate. If none is acceptable, it cycles back to idx.
+//
+// Unlike in-flight loads, rates are checked and updated without
+// compare-and-swap: concurrent Get calls may make an endpoint go slightly over
+// the bound.
+func (c *Consistent) searchRate(r *ring, idx int, excluded []Endpoint, readiness bool) int {
+	now := c.now()
+	totalRate := c.totalRate.get(now, c.loadHalfLife)
+	numEndpoints := int64(r.numEndpoints)
+
+	info := r.nodes[idx].info
+	for n := 0; n < len(r.nodes); n++ {
+		if !c.skip(info.endpoint, excluded, readiness) &&
+			rateOK(totalRate, numEndpoints, info.rate.get(now, c.loadHalfLife), c.loadFactor) {
+			break
+		}
+		idx = r.next(idx)
+		info = r.nodes[idx].info
+	}
+
+	info.rate.add(now, c.loadHalfLife, 1)
+	c.totalRate.add(now, c.loadHalfLife, 1)
+	return idx
+}
+
 // Get implements Algorithm.
 func (c *Consistent) Get(keys ...string) Endpoint {
+	return c.GetExcluding(nil, keys...)
+}
+
+// isExcluded returns true if endpoint is part of the excluded list.
+func isExcluded(endpoint Endpoint, excluded []Endpoint) bool {
+	return len(excluded) > 0 && isIn(endpoint, excluded)
+}
+
+// skip returns true if requests can't be sent to endpoint: it's excluded or,
+// when readiness is true, not ready.
+func (c *Consistent) skip(endpoint Endpoint, excluded []Endpoint, readiness bool) bool {
+	if isExcluded(endpoint, excluded) {
+		return true
+	}
+	if readiness {
+		if r, ok := endpoint.(Readiness); ok && !r.Ready() {
+			return true
+		}
+	}
+	return false
+}
+
+// firstAvailable returns the ring index of the first endpoint from idx that
+// isn't skipped, -1 if there's none.
+func (c *Consistent) firstAvailable(r *ring, idx int, excluded []Endpoint, readiness bool) int {
+	for n := 0; n < len(r.nodes); n++ {
+		if !c.skip(r.nodes[idx].info.endpoint, excluded, readiness) {
+			return idx
+		}
+		idx = r.next(idx)
+	}
+	return -1
+}
+
+// GetExcluding implements Algorithm.
+//
+// Consistent walks the ring past the excluded Endpoints, returning the next
+// best Endpoint for the key.
+//
+// In bounded-load mode, concurrent Get and Put calls update loads without
+// mutual exclusion. The endpoint load is only incremented if it hasn't changed
+// since it was checked against the bound. The total load is incremented after
+// the endpoint load in Get and decremented before it in Put, so it may lag
+// behind the sum of the endpoint loads by up to the number of concurrent Get
+// and Put calls, but is never ahead of it. The bound is checked against the
+// loads seen when the request is assigned: concurrent Put calls may lower the
+// average load right after, and loads read while other calls are in progress
+// are slightly stale. An endpoint load may then exceed LoadFactor *
+// averageLoad by up to the number of concurrent Get and Put calls. When every
+// candidate endpoint is over the bound, the request goes to the first
+// non-excluded one regardless of its load.
+func (c *Consistent) GetExcluding(excluded []Endpoint, keys ...string) Endpoint {
 	if len(keys) != 1 {
 		panic("consistent: affinity key not provided")
 	}
 	key := keys[0]
 
-	c.Lock()
-	defer c.Unlock()
+	// Without bounded loads nothing is mutated and the ring snapshot can be
+	// used without taking the lock. With bounded loads, the read lock ensures
+	// endpoints aren't removed while we update their load.
+	if c.loadFactor != 0 {
+		c.RLock()
+		defer c.RUnlock()
+	}
 
-	if c.isEmpty() {
+	r := c.snapshot()
+	if r.isEmpty() {
 		return nil
 	}
 
-	hash := int(c.hash([]byte(key)))
+	idx := r.search(c.hash([]byte(key)))
 
-	// Binary search for appropriate replica.
-	idx := sort.Search(len(c.keys), func(i int) bool { return c.keys[i] >= hash })
+	// Hot keys are spread across a few endpoints.
+	if c.hotKeys != nil {
+		if hk := c.hotKeys.observe(key); hk != nil {
+			idx = c.spread(r, hk, idx)
+			c.metrics.hot.Inc()
+		}
+	}
 
-	// Means we have cycled back to the first replica.
-	if idx == len(c.keys) {
-		idx = 0
+	// Skip excluded and not ready endpoints.
+	readiness := c.notReady == NotReadyNext
+	available := c.firstAvailable(r, idx, excluded, readiness)
+	if available < 0 && readiness {
+		// No endpoint is ready, ignore readiness.
+		readiness = false
+		available = c.firstAvailable(r, idx, excluded, readiness)
 	}
+	if available < 0 {
+		// All endpoints are excluded.
+		return nil
+	}
+	idx = available
+	info := r.nodes[idx].info
 
 	// No bounded loads, simple consistent hashing.
-	info := c.endpoints[c.keys[idx]]
 	if c.loadFactor == 0 {
 		return info.endpoint
 	}
 
 	startIdx := idx
-
-	// Search for an endpoint with an acceptable load.
-	for {
-		if loadOK(c.totalLoad, c.numEndpoints, info.load, c.loadFactor) {
-			break
-		}
-
-		// Next host, cycling if needed.
-		idx++
-		if idx >= len(c.keys) {
-			idx = 0
+	numEndpoints := int64(r.numEndpoints)
+
+	if c.loadModel == LoadRate {
+		idx = c.searchRate(r, idx, excluded, readiness)
+		info = r.nodes[idx].info
+		atomic.AddInt64(&info.load, 1)
+	} else {
+		// Search for an endpoint with an acceptable load. Excluding endpoints may
+		// leave us with no acceptable endpoint, we then cycle back to the first
+		// non-excluded one.
+		for n := 0; ; {
+			load := atomic.LoadInt64(&info.load)
+			if n >= len(r.nodes) ||
+				(!c.skip(info.endpoint, excluded, readiness) &&
+					loadOK(atomic.LoadInt64(&c.totalLoad), numEndpoints, load, c.loadFactor)) {
+				// Endpoint found, update load. Check again if the load has
+				// changed under our feet.
+				if atomic.CompareAndSwapInt64(&info.load, load, load+1) {
+					break
+				}
+				continue
+			}
+
+			// Next host, cycling if needed.
+			idx = r.next(idx)
+			info = r.nodes[idx].info
+			n++
 		}
-		info = c.endpoints[c.keys[idx]]
 	}
+	atomic.AddInt64(&c.totalLoad, 1)
 
-	// Endpoint found, update load.
-	info.load++
-	c.totalLoad++
-
-	totalLoadGauge.WithLabelValues(c.name).Set(float64(c.totalLoad))
-	requestsCounter.WithLabelValues(c.name).Inc()
+	c.metrics.inflight.Inc()
+	c.metrics.requests.Inc()
 	if idx != startIdx {
-		requestsOverflowedCounter.WithLabelValues(c.name).Inc()
+		atomic.AddInt64(&r.nodes[startIdx].info.overflows, 1)
+		c.metrics.overflowed.Inc()
+	}
+	if m := info.metrics; m != nil {
+		m.inflight.Inc()
+		m.requests.Inc()
+		if idx != startIdx {
+			m.overflowReceived.Inc()
+		}
 	}
 
 	return info.endpoint
@@ -277,20 +849,110 @@ func (c *Consistent) Get(keys ...string) Endpoint {
 
 // Put implements Algorithm.
 func (c *Consistent) Put(endpoint Endpoint) {
-	c.Lock()
-	defer c.Unlock()
-
 	if c.loadFactor == 0 {
 		return
 	}
 
-	// Update load.
-	info := c.info(endpoint.Key())
-	if info == nil {
+	key := endpoint.Key()
+
+	// Fast path, the endpoint is still part of the ring.
+	c.RLock()
+	if info := c.info(key); info != nil {
+		atomic.AddInt64(&c.totalLoad, -1)
+		atomic.AddInt64(&info.load, -1)
+		if info.metrics != nil {
+			info.metrics.inflight.Dec()
+		}
+		c.RUnlock()
+		c.metrics.inflight.Dec()
+		return
+	}
+	c.RUnlock()
+
+	// The endpoint may be draining.
+	c.Lock()
+	info, ok := c.draining[key]
+	if !ok {
+		c.Unlock()
 		return
 	}
 	info.load--
-	c.totalLoad--
+	c.drainingLoad--
+	if info.metrics != nil {
+		info.metrics.inflight.Dec()
+	}
+	drained := info.load == 0
+	if drained {
+		c.stopDraining(info)
+		c.deleteEndpointMetrics(info)
+	}
+	c.Unlock()
+
+	c.metrics.inflight.Dec()
+	if drained {
+		c.updateEndpointsMetrics()
+	}
+}
+
+// ReportError implements ErrorReporter.
+func (c *Consistent) ReportError(endpoint Endpoint) {
+	key := endpoint.Key()
+
+	c.RLock()
+	info := c.info(key)
+	if info == nil {
+		info = c.draining[key]
+	}
+	c.RUnlock()
+
+	if info != nil && info.metrics != nil {
+		info.metrics.errors.Inc()
+	}
+}
+
+// EndpointOwnership describes the part of the hash ring owned by an Endpoint.
+type EndpointOwnership struct {
+	Endpoint Endpoint
+
+	// Fraction is the fraction of the hash space owned by the Endpoint: the
+	// expected share of keys mapped to it.
+	Fraction float64
+
+	// VirtualNodes is the number of virtual nodes of the Endpoint.
+	VirtualNodes int
+
+	// Load is the number of requests currently in-flight. It's only accounted
+	// for with bounded loads.
+	Load int64
+
+	// Overflows is the number of requests for keys mapped to the Endpoint that
+	// have been sent to another Endpoint because it was overloaded.
+	Overflows int64
+}
+
+// Ownership returns how the hash ring is split between Endpoints, sorted by
+// Endpoint key.
+func (c *Consistent) Ownership() []EndpointOwnership {
+	r := c.snapshot()
+
+	vnodes := make(map[*endpointInfo]int, r.numEndpoints)
+	for _, node := range r.nodes {
+		vnodes[node.info]++
+	}
+
+	ownership := make([]EndpointOwnership, 0, r.numEndpoints)
+	for info, fraction := range r.ownership(c.hashBits) {
+		ownership = append(ownership, EndpointOwnership{
+			Endpoint:     info.endpoint,
+			Fraction:     fraction,
+			VirtualNodes: vnodes[info],
+			Load:         atomic.LoadInt64(&info.load),
+			Overflows:    atomic.LoadInt64(&info.overflows),
+		})
+	}
+	sort.Slice(ownership, func(i, j int) bool {
+		return ownership[i].Endpoint.Key() < ownership[j].Endpoint.Key()
+	})
 
-	totalLoadGauge.WithLabelValues(c.name).Set(float64(c.totalLoad))
+	return ownership
 }
@@ -8,8 +8,12 @@ package balance
 
 import (
 	"fmt"
+	"math"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -22,6 +26,16 @@ func testHash(key []byte) uint32 {
 	return uint32(i)
 }
 
+// ringHashes returns the hashes of the virtual nodes of the ring.
+func ringHashes(c *Consistent) []int {
+	r := c.snapshot()
+	hashes := make([]int, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		hashes = append(hashes, int(node.hash))
+	}
+	return hashes
+}
+
 func TestHashing(t *testing.T) {
 
 	// Override the hash function to return easier to reason about values. Assumes
@@ -34,7 +48,7 @@ func TestHashing(t *testing.T) {
 	// Given the above hash function, this will give replicas with "hashes":
 	// 2, 4, 6, 12, 14, 16, 22, 24, 26
 	hash.AddEndpoints(e("6"), e("4"), e("2"))
-	assert.Equal(t, []int{2, 4, 6, 12, 14, 16, 22, 24, 26}, hash.keys)
+	assert.Equal(t, []int{2, 4, 6, 12, 14, 16, 22, 24, 26}, ringHashes(hash))
 	assert.Equal(t, hash.numEndpoints, 3)
 
 	testCases := map[string]Endpoint{
@@ -50,7 +64,7 @@ func TestHashing(t *testing.T) {
 
 	// Adds 8, 18, 28
 	hash.AddEndpoints(e("8"))
-	assert.Equal(t, []int{2, 4, 6, 8, 12, 14, 16, 18, 22, 24, 26, 28}, hash.keys)
+	assert.Equal(t, []int{2, 4, 6, 8, 12, 14, 16, 18, 22, 24, 26, 28}, ringHashes(hash))
 	assert.Equal(t, hash.numEndpoints, 4)
 
 	// 27 should now map to 8.
@@ -62,7 +76,7 @@ func TestHashing(t *testing.T) {
 
 	// Removes 8, 18, 28
 	hash.RemoveEndpoints(e("8"))
-	assert.Equal(t, []int{2, 4, 6, 12, 14, 16, 22, 24, 26}, hash.keys)
+	assert.Equal(t, []int{2, 4, 6, 12, 14, 16, 22, 24, 26}, ringHashes(hash))
 	assert.Equal(t, hash.numEndpoints, 3)
 
 	// 27 should now map to 2 again.
@@ -73,6 +87,51 @@ func TestHashing(t *testing.T) {
 	}
 }
 
+func TestHashCollisions(t *testing.T) {
+	// With 13 replicas, replica 1 of "23" and replica 12 of "3" both hash to
+	// 123.
+	newHash := func() *Consistent {
+		return NewConsistent(ConsistentConfig{
+			ReplicationCount: 13,
+			Hash:             testHash,
+		})
+	}
+
+	hash1 := newHash()
+	hash1.AddEndpoints(e("23"), e("3"))
+	hash2 := newHash()
+	hash2.AddEndpoints(e("3"))
+	hash2.AddEndpoints(e("23"))
+
+	// Both virtual nodes are on the ring and the tie is broken the same way
+	// whatever the order endpoints were added in.
+	assert.Len(t, ringHashes(hash1), 26)
+	assert.Equal(t, ringHashes(hash1), ringHashes(hash2))
+	assert.Equal(t, "23", hash1.Get("123").Key())
+	assert.Equal(t, "23", hash2.Get("123").Key())
+
+	assert.Equal(t, e("23"), hash1.info("23").endpoint)
+	assert.Equal(t, e("3"), hash1.info("3").endpoint)
+
+	// Removing one endpoint leaves the colliding node of the other one.
+	hash1.RemoveEndpoints(e("23"))
+	assert.Len(t, ringHashes(hash1), 13)
+	assert.Equal(t, "3", hash1.Get("123").Key())
+	assert.Nil(t, hash1.info("23"))
+}
+
+func TestAddEndpointsTwice(t *testing.T) {
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 3,
+		Hash:             testHash,
+	})
+
+	hash.AddEndpoints(e("2"), e("2"))
+	hash.AddEndpoints(e("2"))
+	assert.Equal(t, []int{2, 12, 22}, ringHashes(hash))
+	assert.Equal(t, 1, hash.numEndpoints)
+}
+
 func TestConsistency(t *testing.T) {
 	hash1 := NewConsistent(ConsistentConfig{ReplicationCount: 1})
 	hash2 := NewConsistent(ConsistentConfig{ReplicationCount: 1})
@@ -106,19 +165,295 @@ func TestEndpointDisappearing(t *testing.T) {
 	assert.Equal(t, "2", endpoint2.Key())
 	endpoint4 := hash.Get("33")
 	assert.Equal(t, "4", endpoint4.Key())
-	assert.Equal(t, 2, hash.totalLoad)
+	assert.EqualValues(t, 2, hash.totalLoad)
 
 	// Remove endpoints that had requests pending. The load should be
-	// adjustedAnd and Put() be a no op.
+	// adjusted and the endpoints kept around until their requests finish.
 	hash.RemoveEndpoints(endpoint2, endpoint4)
-	assert.Equal(t, 0, hash.totalLoad)
+	assert.EqualValues(t, 0, hash.totalLoad)
+	assert.EqualValues(t, 2, hash.drainingLoad)
+	assert.Len(t, hash.draining, 2)
+
+	// Draining endpoints don't receive new requests.
+	assert.Equal(t, "6", hash.Get("11").Key())
+
 	hash.Put(endpoint2)
 	hash.Put(endpoint4)
+	assert.EqualValues(t, 1, hash.totalLoad)
+	assert.EqualValues(t, 0, hash.drainingLoad)
+	assert.Len(t, hash.draining, 0)
+
+	// Put is a no-op once the endpoints are fully drained.
+	hash.Put(endpoint2)
+	assert.EqualValues(t, 1, hash.totalLoad)
+	assert.EqualValues(t, 0, hash.drainingLoad)
+}
+
+func TestEndpointDrainTimeout(t *testing.T) {
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 3,
+		Hash:             testHash,
+		LoadFactor:       1.25,
+		DrainTimeout:     10 * time.Millisecond,
+	})
+
+	hash.AddEndpoints(e("6"), e("4"), e("2"))
+	endpoint := hash.Get("11")
+	hash.RemoveEndpoints(endpoint)
+	assert.EqualValues(t, 1, hash.drainingLoad)
+
+	drained := func() bool {
+		hash.Lock()
+		defer hash.Unlock()
+		return len(hash.draining) == 0 && hash.drainingLoad == 0
+	}
+	for start := time.Now(); !drained() && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, drained())
+
+	// Put after the timeout is a no-op.
+	hash.Put(endpoint)
+	assert.EqualValues(t, 0, hash.totalLoad)
+	assert.EqualValues(t, 0, hash.drainingLoad)
+}
+
+func TestEndpointDrainReAdd(t *testing.T) {
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 3,
+		Hash:             testHash,
+		LoadFactor:       1.25,
+	})
+
+	hash.AddEndpoints(e("6"), e("4"), e("2"))
+	endpoint := hash.Get("11")
+	hash.RemoveEndpoints(endpoint)
+
+	// Adding back a draining endpoint keeps its in-flight requests.
+	hash.AddEndpoints(endpoint)
+	assert.EqualValues(t, 1, hash.totalLoad)
+	assert.EqualValues(t, 0, hash.drainingLoad)
+	assert.EqualValues(t, 1, hash.info("2").load)
+	assert.Len(t, hash.draining, 0)
+
+	hash.Put(endpoint)
+	assert.EqualValues(t, 0, hash.totalLoad)
+	assert.EqualValues(t, 0, hash.info("2").load)
+}
+
+func TestGetExcluding(t *testing.T) {
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 3,
+		Hash:             testHash,
+	})
+	hash.AddEndpoints(e("6"), e("4"), e("2"))
+
+	// 11 maps to 2, then walks the ring to 4 and 6.
+	assert.Equal(t, "2", hash.GetExcluding(nil, "11").Key())
+	assert.Equal(t, "4", hash.GetExcluding(el("2"), "11").Key())
+	assert.Equal(t, "6", hash.GetExcluding(el("2", "4"), "11").Key())
+	assert.Nil(t, hash.GetExcluding(el("2", "4", "6"), "11"))
+}
+
+func TestGetExcludingBoundedLoad(t *testing.T) {
+	hash := makeTestHash(1.20, boundedState{
+		{"6", 30},
+		{"4", 22},
+		{"2", 24},
+		{"7", 23},
+	})
+
+	// 15 maps to 6 which is overloaded, overflows to 7.
+	endpoint := hash.GetExcluding(nil, "15")
+	assert.Equal(t, "7", endpoint.Key())
+	hash.Put(endpoint)
+	// Excluding 7, the next endpoint with an acceptable load is 2.
+	assert.Equal(t, "2", hash.GetExcluding(el("7"), "15").Key())
+
+	// When no acceptable endpoint remains, settle for the first non-excluded
+	// one.
+	hash = makeTestHash(1.20, boundedState{
+		{"6", 30},
+		{"4", 0},
+	})
+	assert.Equal(t, "6", hash.GetExcluding(el("4"), "15").Key())
+	assert.Nil(t, hash.GetExcluding(el("4", "6"), "15"))
+}
+
+func TestOwnership(t *testing.T) {
+	hash := makeTestHash(1.25, boundedState{
+		{"2", 0},
+		{"4", 0},
+		{"6", 0},
+	})
+
+	// 2 gets the request for 11 and 4 gets the overflow.
+	hash.Get("11")
+	hash.Get("11")
+
+	// Virtual nodes are at 2, 4, 6, 12, 14, 16, 22, 24 and 26. 4 and 6 own 3
+	// arcs of length 2, 2 owns everything else.
+	ownership := hash.Ownership()
+	assert.Len(t, ownership, 3)
+	assert.Equal(t, "2", ownership[0].Endpoint.Key())
+	assert.InDelta(t, 1-12/math.Exp2(32), ownership[0].Fraction, 1e-12)
+	assert.Equal(t, 6/math.Exp2(32), ownership[1].Fraction)
+	assert.Equal(t, EndpointOwnership{
+		Endpoint:     ownership[0].Endpoint,
+		Fraction:     ownership[0].Fraction,
+		VirtualNodes: 3,
+		Load:         1,
+		Overflows:    1,
+	}, ownership[0])
+	assert.Equal(t, int64(1), ownership[1].Load)
+	assert.Equal(t, int64(0), ownership[1].Overflows)
+}
+
+func TestRemapReport(t *testing.T) {
+	var reports []RemapReport
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 3,
+		Hash:             testHash,
+		OnRemap: func(report RemapReport) {
+			reports = append(reports, report)
+		},
+	})
+
+	// No report for the first endpoints.
+	hash.AddEndpoints(e("2"), e("4"))
+	assert.Empty(t, reports)
+
+	// 6 takes (4, 6], (14, 16] and (24, 26] from 2.
+	hash.AddEndpoints(e("6"))
+	assert.Len(t, reports, 1)
+	assert.Equal(t, map[string]map[string]float64{
+		"2": {"6": 6 / math.Exp2(32)},
+	}, reports[0].Moves)
+	assert.Equal(t, 6/math.Exp2(32), reports[0].Moved)
+
+	// Removing 2 moves everything it owned to 4.
+	hash.RemoveEndpoints(e("2"))
+	assert.Len(t, reports, 2)
+	assert.InDelta(t, 1-12/math.Exp2(32), reports[1].Moved, 1e-12)
+	assert.Len(t, reports[1].Moves, 1)
+	assert.Len(t, reports[1].Moves["2"], 1)
+	assert.Contains(t, reports[1].Moves["2"], "4")
+
+	// No change, no report.
+	hash.AddEndpoints(e("4"))
+	assert.Len(t, reports, 2)
+}
+
+// re is a test Endpoint with a readiness state.
+type re struct {
+	key   string
+	ready bool
+}
+
+func (e *re) Key() string { return e.key }
+func (e *re) Ready() bool { return e.ready }
+
+func TestNotReady(t *testing.T) {
+	two, four, six := &re{"2", true}, &re{"4", true}, &re{"6", true}
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 3,
+		Hash:             testHash,
+	})
+	hash.AddEndpoints(two, four, six)
+	assert.Equal(t, "2", hash.Get("11").Key())
+
+	// Requests go to the next ready endpoint while 2 isn't ready.
+	two.ready = false
+	assert.Equal(t, "4", hash.Get("11").Key())
+	assert.Equal(t, "4", hash.Get("13").Key())
+	two.ready = true
+	assert.Equal(t, "2", hash.Get("11").Key())
+
+	// Readiness is ignored when no endpoint is ready.
+	two.ready, four.ready, six.ready = false, false, false
+	assert.Equal(t, "2", hash.Get("11").Key())
+	assert.Nil(t, hash.GetExcluding(el("2", "4", "6"), "11"))
+
+	ignore := NewConsistent(ConsistentConfig{
+		ReplicationCount: 3,
+		Hash:             testHash,
+		NotReady:         NotReadyIgnore,
+	})
+	ignore.AddEndpoints(two, &re{"4", true})
+	assert.Equal(t, "2", ignore.Get("11").Key())
+}
+
+func TestNotReadyBoundedLoad(t *testing.T) {
+	two, four, six := &re{"2", false}, &re{"4", true}, &re{"6", true}
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 3,
+		Hash:             testHash,
+		LoadFactor:       1.25,
+	})
+	hash.AddEndpoints(two, four, six)
+
+	// 2 is never picked, even when 4 overflows.
+	assert.Equal(t, "4", hash.Get("11").Key())
+	assert.Equal(t, "6", hash.Get("11").Key())
+	assert.Equal(t, int64(0), hash.info("2").load)
+}
+
+// we is a test Endpoint with a weight.
+type we struct {
+	key    string
+	weight int
+}
+
+func (e *we) Key() string { return e.key }
+func (e *we) Weight() int { return e.weight }
+
+func TestWeights(t *testing.T) {
+	a, b := &we{"a", 100}, &we{"b", 50}
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 10,
+	})
+	hash.AddEndpoints(a, b)
+
+	vnodes := func() []int {
+		var n []int
+		for _, o := range hash.Ownership() {
+			n = append(n, o.VirtualNodes)
+		}
+		return n
+	}
+	assert.Equal(t, []int{10, 5}, vnodes())
+
+	// Keys mapped to b stay on b when b gets heavier.
+	owner := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		owner[key] = hash.Get(key).Key()
+	}
+
+	b.weight = 300
+	hash.UpdateWeights(b)
+	assert.Equal(t, []int{10, 30}, vnodes())
+	for key, endpoint := range owner {
+		if endpoint == "b" {
+			assert.Equal(t, "b", hash.Get(key).Key())
+		}
+	}
+
+	// And back, weights are clamped to one virtual node.
+	b.weight = 0
+	hash.UpdateWeights(b)
+	assert.Equal(t, []int{10, 1}, vnodes())
+	assert.Len(t, hash.snapshot().nodes, 11)
+
+	// Large weights are clamped to MaxWeight.
+	b.weight = 1000000
+	hash.UpdateWeights(b)
+	assert.Equal(t, []int{10, 100}, vnodes())
 }
 
 func TestLoadOK(t *testing.T) {
 	tests := []struct {
-		totalLoad, numEndpoints, endpointLoad int
+		totalLoad, numEndpoints, endpointLoad int64
 		factor                                float64
 		expected                              bool
 	}{
@@ -136,13 +471,13 @@ func TestLoadOK(t *testing.T) {
 
 type testEndpoint struct {
 	key  string
-	load int
+	load int64
 }
 
 type boundedState []testEndpoint
 
-func (s boundedState) totalLoad() int {
-	load := 0
+func (s boundedState) totalLoad() int64 {
+	load := int64(0)
 	for i := range s {
 		load += s[i].load
 	}
@@ -170,7 +505,7 @@ func makeTestHash(loadFactor float64, state boundedState) *Consistent {
 type getOperation struct {
 	key              string
 	expectedEndpoint string
-	expectedLoad     int
+	expectedLoad     int64
 }
 
 func TestBoundedLoad(t *testing.T) {
@@ -228,6 +563,63 @@ func TestBoundedLoad(t *testing.T) {
 	}
 }
 
+func TestBoundedLoadConcurrent(t *testing.T) {
+	const (
+		workers    = 8
+		loadFactor = 1.25
+		// Leases held by each worker, so loads can build up.
+		window = 4
+	)
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 50,
+		LoadFactor:       loadFactor,
+	})
+	endpoints := makeBenchEndpoints(8)
+	hash.AddEndpoints(endpoints...)
+
+	// Endpoint loads stay within LoadFactor * averageLoad, give or take the
+	// number of concurrent callers.
+	var overloaded int64
+	checkBound := func(endpoint Endpoint) {
+		load := atomic.LoadInt64(&hash.info(endpoint.Key()).load)
+		totalLoad := atomic.LoadInt64(&hash.totalLoad)
+		bound := math.Ceil(loadFactor*float64(totalLoad+1)/float64(len(endpoints))) + workers
+		if float64(load) > bound {
+			atomic.AddInt64(&overloaded, 1)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var held []Endpoint
+			for j := 0; j < 1000; j++ {
+				endpoint := hash.Get(fmt.Sprintf("key-%d", (i*j)%13))
+				checkBound(endpoint)
+				held = append(held, endpoint)
+				if len(held) == window {
+					hash.Put(held[0])
+					held = held[1:]
+				}
+			}
+			for _, endpoint := range held {
+				hash.Put(endpoint)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 0, overloaded)
+
+	// Load accounting must be back to 0.
+	assert.EqualValues(t, 0, hash.totalLoad)
+	for _, endpoint := range endpoints {
+		assert.EqualValues(t, 0, hash.info(endpoint.Key()).load)
+	}
+}
+
 func BenchmarkGet8(b *testing.B)   { benchmarkGet(b, 8) }
 func BenchmarkGet32(b *testing.B)  { benchmarkGet(b, 32) }
 func BenchmarkGet128(b *testing.B) { benchmarkGet(b, 128) }
@@ -250,3 +642,74 @@ func benchmarkGet(b *testing.B, shards int) {
 		hash.Get(buckets[i&(shards-1)].Key())
 	}
 }
+
+func BenchmarkGetParallel(b *testing.B) {
+	hash := NewConsistent(ConsistentConfig{})
+	hash.AddEndpoints(makeBenchEndpoints(32)...)
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			hash.Get("foo")
+		}
+	})
+}
+
+func BenchmarkGetPutBoundedParallel(b *testing.B) {
+	hash := NewConsistent(ConsistentConfig{LoadFactor: 1.25})
+	hash.AddEndpoints(makeBenchEndpoints(32)...)
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			hash.Put(hash.Get("foo"))
+		}
+	})
+}
+
+func makeBenchEndpoints(n int) []Endpoint {
+	endpoints := make([]Endpoint, 0, n)
+	for i := 0; i < n; i++ {
+		endpoints = append(endpoints, e(fmt.Sprintf("10.0.%d.%d:8080", i/256, i%256)))
+	}
+	return endpoints
+}
+
+func BenchmarkAddEndpoints300(b *testing.B) {
+	endpoints := makeBenchEndpoints(300)
+
+	for i := 0; i < b.N; i++ {
+		hash := NewConsistent(ConsistentConfig{})
+		hash.AddEndpoints(endpoints...)
+	}
+}
+
+func BenchmarkRemoveEndpoints300(b *testing.B) {
+	endpoints := makeBenchEndpoints(300)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		hash := NewConsistent(ConsistentConfig{})
+		hash.AddEndpoints(endpoints...)
+		b.StartTimer()
+
+		hash.RemoveEndpoints(endpoints...)
+	}
+}
+
+// Rolling update: one endpoint is replaced by another one.
+func BenchmarkRollingUpdate300(b *testing.B) {
+	endpoints := makeBenchEndpoints(301)
+	hash := NewConsistent(ConsistentConfig{})
+	hash.AddEndpoints(endpoints[:300]...)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		old, new := endpoints[i%301], endpoints[(i+300)%301]
+		hash.RemoveEndpoints(old)
+		hash.AddEndpoints(new)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -91,8 +93,8 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	r.Host = endpoint.Key()
-	r.URL.Host = endpoint.Key()
+	r.Host = balance.Address(endpoint)
+	r.URL.Host = balance.Address(endpoint)
 	r.URL.Scheme = "http"
 
 	p.reverse.ServeHTTP(w, r)
@@ -105,11 +107,13 @@ type options struct {
 	kubeconfig  string
 	namespace   string
 	service     string
+	port        string
 	listen      string
 	header      string
 	keepAlive   bool
 	noForward   bool
 	method      string
+	hash        string
 	boundedLoad struct {
 		loadFactor float64
 	}
@@ -118,11 +122,20 @@ type options struct {
 func makeLoadBalancer(opts *options, service *balance.Service) (*balance.LoadBalancer, error) {
 	var algo balance.Algorithm
 
+	if opts.hash != "" {
+		if _, err := balance.HashByName(opts.hash); err != nil {
+			return nil, err
+		}
+	}
+
 	switch opts.method {
 	case "consistent":
-		algo = balance.NewConsistent(balance.ConsistentConfig{})
+		algo = balance.NewConsistent(balance.ConsistentConfig{
+			HashName: opts.hash,
+		})
 	case "bounded-load":
 		algo = balance.NewConsistent(balance.ConsistentConfig{
+			HashName:   opts.hash,
 			LoadFactor: opts.boundedLoad.loadFactor,
 		})
 	default:
@@ -139,11 +152,13 @@ func main() {
 	flag.StringVar(&opts.kubeconfig, "k8s.kubeconfig", "", "(optional) absolute path to the kubeconfig file")
 	flag.StringVar(&opts.namespace, "k8s.namespace", "default", "namespace of the service to load balance")
 	flag.StringVar(&opts.service, "k8s.service", "", "name of the service to load balance")
+	flag.StringVar(&opts.port, "k8s.port", "8080", "port, name or number, of the service to load balance")
 	flag.StringVar(&opts.listen, "proxy.listen", ":8081", "address the proxy should listen on")
 	flag.StringVar(&opts.header, "proxy.header", "X-Affinity", "name of the HTTP header taken as input")
 	flag.BoolVar(&opts.keepAlive, "proxy.keep-alive", true, "whether the proxy should keep its connections to endpoints alive")
 	flag.BoolVar(&opts.noForward, "proxy.no-forward", false, "don't forward request downstream (debug)")
 	flag.StringVar(&opts.method, "proxy.method", "bounded-load", "which load balancing method should be used (one of consistent, bounded-load)")
+	flag.StringVar(&opts.hash, "proxy.hash", "", fmt.Sprintf("hash function used by hashing methods (one of %s, defaults to crc32)", strings.Join(balance.HashNames(), ", ")))
 	flag.Float64Var(&opts.boundedLoad.loadFactor, "proxy.bounded-load.load-factor", 1.25, "spread of the maximum load from the average load")
 	flag.Parse()
 
@@ -156,7 +171,7 @@ func main() {
 	service := &balance.Service{
 		Namespace: opts.namespace,
 		Name:      opts.service,
-		Port:      "8080",
+		Port:      opts.port,
 	}
 
 	balancer, err := makeLoadBalancer(&opts, service)
@@ -164,7 +179,15 @@ func main() {
 		log.Fatal(err)
 	}
 
-	balancer.Start(make(<-chan interface{}))
+	if err := balancer.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := balancer.WaitForSync(ctx); err != nil {
+		log.Warnf("endpoints of %s not known yet: %v", service, err)
+	}
+	cancel()
 
 	proxy := &proxy{
 		noForward: opts.noForward,
@@ -1,18 +1,177 @@
 package balance
 
-// kubernetesEndpoint is a Kubernetes Service endpoint.
-type kubernetesEndpoint struct {
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// EndpointMetadata describes the Kubernetes object behind an Endpoint.
+type EndpointMetadata struct {
+	// Address is the address of the Endpoint, host:port.
 	Address string
+	// IP is the IP address of the Endpoint.
+	IP string
+	// Port is the port of the Endpoint. For multi-port Endpoints, it's the
+	// primary port.
+	Port int32
+	// Ports maps the port names or numbers a multi-port Endpoint is served on,
+	// as given to the watcher, to their port number. See PortAddress.
+	Ports map[string]int32
+	// Hostname is the hostname of the Endpoint, set for pods of StatefulSets or
+	// pods with a hostname and subdomain.
+	Hostname string
+	// NodeName is the name of the node hosting the Endpoint.
+	NodeName string
+	// Zone is the zone of the node hosting the Endpoint. It's only set when the
+	// watcher looks up zones.
+	Zone string
+	// TargetRef references the object behind the Endpoint, usually a pod.
+	TargetRef *ObjectReference
+	// PodName is the name of the pod behind the Endpoint, if any.
+	PodName string
+	// Labels are the pod labels. They are only set when the watcher looks up
+	// pod labels.
+	Labels map[string]string
+	// Annotations are the pod annotations. They are only set when the watcher
+	// looks up pod annotations.
+	Annotations map[string]string
+	// Weight is the weight of the Endpoint. It's only set when the watcher
+	// looks up weights, see Weighted.
+	Weight int
+	// Ready is false when the Endpoint is not ready to serve requests. Not
+	// ready Endpoints are only known when the watcher tracks them.
+	Ready bool
+}
+
+// ObjectReference references a Kubernetes object.
+type ObjectReference struct {
+	Kind      string
+	Namespace string
+	Name      string
+	UID       string
+}
+
+// Address returns the address requests for endpoint should be sent to. It's
+// the Endpoint key unless the Endpoint implements Addressed.
+func Address(endpoint Endpoint) string {
+	if addressed, ok := endpoint.(Addressed); ok {
+		return addressed.Address()
+	}
+	return endpoint.Key()
+}
+
+// PortAddress returns the address of endpoint for port, a port name or number.
+// Multi-port Endpoints are served on the ports listed in their metadata, see
+// EndpointMetadata.Ports, other Endpoints on their primary port only. Endpoints
+// without metadata, eg. fallback Endpoints, are assumed to be served on any
+// port number.
+//
+// ok is false when endpoint isn't served on port.
+func PortAddress(endpoint Endpoint, port string) (address string, ok bool) {
+	if described, isDescribed := endpoint.(Described); isDescribed {
+		metadata := described.Metadata()
+		if metadata.IP != "" {
+			number, ok := metadata.Ports[port]
+			if !ok && port == strconv.Itoa(int(metadata.Port)) {
+				number, ok = metadata.Port, true
+			}
+			if !ok {
+				return "", false
+			}
+			return net.JoinHostPort(metadata.IP, strconv.Itoa(int(number))), true
+		}
+	}
+
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", false
+	}
+	host, _ := splitHostPort(Address(endpoint))
+	return joinHostPort(host, port), true
+}
+
+// kubernetesEndpoint is a Kubernetes Service endpoint. Its key doesn't change
+// but its metadata, eg. its address when not keyed by address or its
+// readiness, may be updated in place.
+type kubernetesEndpoint struct {
+	key   string
+	ready int32 // atomic, mirrors metadata.Ready for lock-free Ready calls
+
+	sync.RWMutex
+	metadata EndpointMetadata
+}
+
+// newKubernetesEndpoint creates a new kubernetesEndpoint object.
+func newKubernetesEndpoint(key string, metadata EndpointMetadata) *kubernetesEndpoint {
+	e := &kubernetesEndpoint{key: key}
+	e.update(metadata)
+	return e
 }
 
 var _ Endpoint = &kubernetesEndpoint{}
+var _ Addressed = &kubernetesEndpoint{}
+var _ Labeled = &kubernetesEndpoint{}
+var _ Described = &kubernetesEndpoint{}
+var _ Readiness = &kubernetesEndpoint{}
+var _ Weighted = &kubernetesEndpoint{}
 
 // Key implements Endpoint.
 func (e *kubernetesEndpoint) Key() string {
-	return e.Address
+	return e.key
+}
+
+// Address implements Addressed.
+func (e *kubernetesEndpoint) Address() string {
+	e.RLock()
+	defer e.RUnlock()
+	return e.metadata.Address
+}
+
+// Labels implements Labeled.
+func (e *kubernetesEndpoint) Labels() map[string]string {
+	e.RLock()
+	defer e.RUnlock()
+	return e.metadata.Labels
+}
+
+// Metadata implements Described.
+func (e *kubernetesEndpoint) Metadata() EndpointMetadata {
+	e.RLock()
+	defer e.RUnlock()
+	return e.metadata
+}
+
+// Ready implements Readiness. It's called on each request and doesn't take
+// the lock.
+func (e *kubernetesEndpoint) Ready() bool {
+	return atomic.LoadInt32(&e.ready) != 0
+}
+
+// Weight implements Weighted.
+func (e *kubernetesEndpoint) Weight() int {
+	e.RLock()
+	defer e.RUnlock()
+	if e.metadata.Weight == 0 {
+		return DefaultWeight
+	}
+	return e.metadata.Weight
+}
+
+// update replaces the endpoint metadata.
+func (e *kubernetesEndpoint) update(metadata EndpointMetadata) {
+	var ready int32
+	if metadata.Ready {
+		ready = 1
+	}
+
+	e.Lock()
+	e.metadata = metadata
+	atomic.StoreInt32(&e.ready, ready)
+	e.Unlock()
 }
 
 // String implements fmt.Stringer.
 func (e *kubernetesEndpoint) String() string {
-	return e.Address
+	return e.key
 }
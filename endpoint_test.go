@@ -1,5 +1,11 @@
 package balance
 
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
 // e dummy implementation of Endpoint for testing.
 type e string
 
@@ -22,3 +28,12 @@ func keys(endpoints []Endpoint) []string {
 	}
 	return keys
 }
+
+func TestKubernetesEndpointReady(t *testing.T) {
+	endpoint := newKubernetesEndpoint("10.0.0.1:8080", EndpointMetadata{Ready: true})
+	assert.True(t, endpoint.Ready())
+
+	endpoint.update(EndpointMetadata{Ready: false})
+	assert.False(t, endpoint.Ready())
+	assert.False(t, endpoint.Metadata().Ready)
+}
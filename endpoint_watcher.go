@@ -1,43 +1,324 @@
 package balance
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	corev1 "k8s.io/api/core/v1"
-	errors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	watch "k8s.io/apimachinery/pkg/watch"
 	client "k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
-// EndpointWatcher load balances requests.
+const (
+	defaultResync = 10 * time.Minute
+)
+
+var errWatcherStopped = errors.New("watcher: stopped")
+
+// KeyBy selects what identifies Endpoints, and consequently where they are
+// placed by affinity load balancing algorithms.
+type KeyBy int
+
+const (
+	// KeyByAddress identifies Endpoints by their IP:port address.
+	KeyByAddress KeyBy = iota
+	// KeyByPodName identifies Endpoints by their pod name and port, eg.
+	// db-2:5432. A StatefulSet pod restarting with a new IP keeps its key.
+	// Endpoints without a pod are identified by their address.
+	KeyByPodName
+	// KeyByHostname identifies Endpoints by their hostname and port. Endpoints
+	// without a hostname are identified by their address.
+	KeyByHostname
+)
+
+// EndpointWatcher watches the Endpoints object of a Service and feeds its
+// addresses to an EndpointSet.
 type EndpointWatcher struct {
 	Client   client.Interface
 	Service  Service
 	Receiver EndpointSet
+	// PodLabels makes the watcher attach the labels of the pod behind each
+	// Endpoint. Endpoints then implement Labeled. Pods are then watched and
+	// label changes are given to Receiver if it implements LabelUpdater.
+	PodLabels bool
+	// PodAnnotations makes the watcher attach the annotations of the pod
+	// behind each Endpoint to their metadata. Pods are then watched.
+	PodAnnotations bool
+	// Zones makes the watcher look up the zone of the node hosting each
+	// Endpoint.
+	Zones bool
+	// KeyBy selects what identifies Endpoints. When not keyed by address, the
+	// address of an Endpoint is updated in place, use Address to retrieve it.
+	// Defaults to KeyByAddress.
+	KeyBy KeyBy
+	// NotReadyAddresses makes the watcher track the addresses that aren't
+	// ready. Endpoints then implement Readiness and keep their place in the
+	// load balancer when their readiness changes.
+	NotReadyAddresses bool
+	// Weights selects where Endpoint weights are read from. Pods are then
+	// watched and weight changes are given to Receiver if it implements
+	// WeightUpdater.
+	// Defaults to WeightNone.
+	Weights WeightSource
+	// Ports lists additional ports, names or numbers, Endpoints are served on.
+	// When set, there's one Endpoint per address rather than one per address
+	// and port: Endpoints are identified independently of their ports and carry
+	// all their ports, see PortAddress. The Service port is the primary port of
+	// Endpoints.
+	Ports []string
+	// Resync is the period at which the informer re-delivers its cached
+	// Endpoints object to the watcher. Only the differences with the previous
+	// delivery reach the Receiver, so a resync doesn't repair a Receiver that
+	// was changed behind the watcher's back.
+	// Defaults to 10 minutes.
+	Resync time.Duration
+	// OnError, if set, is called with the errors encountered talking to the
+	// API server. Failed requests are retried, see Status for the state of the
+	// connection. It's called synchronously from the watcher goroutine.
+	OnError func(err error)
+	// RetryInitial is the delay before retrying a failed request to the API
+	// server. It doubles with each consecutive failure, up to RetryMax, and is
+	// jittered.
+	// Defaults to 1 second.
+	RetryInitial time.Duration
+	// RetryMax is the maximum delay between retries of failed requests.
+	// Defaults to 1 minute.
+	RetryMax time.Duration
 
+	sync.Mutex        // Serializes Receiver updates
+	informer          cache.SharedIndexInformer
+	podInformer       cache.SharedIndexInformer
+	synced            bool // The Endpoints object has been given to Receiver
+	wg                sync.WaitGroup
+	status            watcherStatus // Endpoints watch
+	podStatus         watcherStatus // Pod watch
 	previousEndpoints []Endpoint
+	zones             map[string]string // node name -> zone
+	pods              corelisters.PodLister
+}
+
+// Well-known node labels holding the node zone.
+var zoneLabels = []string{
+	"topology.kubernetes.io/zone",
+	"failure-domain.beta.kubernetes.io/zone",
+}
+
+// needsPods returns true if Endpoints carry data from their pod.
+func (w *EndpointWatcher) needsPods() bool {
+	return w.PodLabels || w.PodAnnotations || w.Weights != WeightNone
+}
+
+// pod returns the pod referenced by address, if any. Once started, the watcher
+// retrieves pods from the cache of its pod informer.
+func (w *EndpointWatcher) pod(address *corev1.EndpointAddress) *corev1.Pod {
+	ref := address.TargetRef
+	if ref == nil || ref.Kind != "Pod" {
+		return nil
+	}
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = w.Service.Namespace
+	}
+
+	var pod *corev1.Pod
+	var err error
+	if w.pods != nil && namespace == w.Service.Namespace {
+		pod, err = w.pods.Pods(namespace).Get(ref.Name)
+	} else {
+		pod, err = w.Client.CoreV1().Pods(namespace).Get(ref.Name, metav1.GetOptions{})
+	}
+	if err != nil {
+		log.Errorf("watcher: could not retrieve pod %s/%s: %v", namespace, ref.Name, err)
+		return nil
+	}
+	return pod
+}
+
+// zone returns the zone of node. Zones are cached as they don't change during
+// the lifetime of a node.
+func (w *EndpointWatcher) zone(node string) string {
+	if zone, ok := w.zones[node]; ok {
+		return zone
+	}
+
+	n, err := w.Client.CoreV1().Nodes().Get(node, metav1.GetOptions{})
+	if err != nil {
+		log.Errorf("watcher: could not retrieve node %s: %v", node, err)
+		return ""
+	}
+
+	var zone string
+	for _, label := range zoneLabels {
+		if zone = n.Labels[label]; zone != "" {
+			break
+		}
+	}
+
+	if w.zones == nil {
+		w.zones = make(map[string]string)
+	}
+	w.zones[node] = zone
+	return zone
+}
+
+// makeMetadata returns the metadata shared by the Endpoints of address.
+func (w *EndpointWatcher) makeMetadata(address *corev1.EndpointAddress, ready bool) EndpointMetadata {
+	metadata := EndpointMetadata{
+		IP:       address.IP,
+		Hostname: address.Hostname,
+		Ready:    ready,
+	}
+
+	if address.NodeName != nil {
+		metadata.NodeName = *address.NodeName
+		if w.Zones {
+			metadata.Zone = w.zone(metadata.NodeName)
+		}
+	}
+
+	if ref := address.TargetRef; ref != nil {
+		metadata.TargetRef = &ObjectReference{
+			Kind:      ref.Kind,
+			Namespace: ref.Namespace,
+			Name:      ref.Name,
+			UID:       string(ref.UID),
+		}
+		if ref.Kind == "Pod" {
+			metadata.PodName = ref.Name
+		}
+	}
+
+	if w.Weights != WeightNone {
+		metadata.Weight = DefaultWeight
+	}
+
+	if w.needsPods() {
+		if pod := w.pod(address); pod != nil {
+			w.setPodMetadata(&metadata, pod)
+		}
+	}
+
+	return metadata
+}
+
+// setPodMetadata sets the metadata of an Endpoint coming from its pod.
+func (w *EndpointWatcher) setPodMetadata(metadata *EndpointMetadata, pod *corev1.Pod) {
+	if w.PodLabels {
+		metadata.Labels = pod.Labels
+	}
+	if w.PodAnnotations {
+		metadata.Annotations = pod.Annotations
+	}
+	if w.Weights != WeightNone {
+		metadata.Weight = podWeight(pod, w.Weights)
+	}
+}
+
+// key returns the key of the Endpoint described by metadata.
+func (w *EndpointWatcher) key(metadata *EndpointMetadata) string {
+	var name string
+	switch w.KeyBy {
+	case KeyByPodName:
+		name = metadata.PodName
+	case KeyByHostname:
+		name = metadata.Hostname
+	}
+
+	// Multi-port Endpoints are identified independently of their ports.
+	if len(w.Ports) > 0 {
+		if name == "" {
+			return metadata.IP
+		}
+		return name
+	}
+
+	if name == "" {
+		return metadata.Address
+	}
+	return net.JoinHostPort(name, strconv.Itoa(int(metadata.Port)))
+}
+
+// matchPort returns true if port is identified by name, a port name or number.
+func matchPort(port *corev1.EndpointPort, name string) bool {
+	if number, err := strconv.Atoi(name); err == nil {
+		return int(port.Port) == number
+	}
+	return port.Name == name
+}
+
+// makeMultiPortEndpoint returns the Endpoint of address with all the ports of
+// the watcher, nil if address has none of them. The Service port is the
+// primary port of the Endpoint, used for its address.
+func (w *EndpointWatcher) makeMultiPortEndpoint(subset *corev1.EndpointSubset, metadata EndpointMetadata) Endpoint {
+	names := append([]string{w.Service.Port}, w.Ports...)
+
+	var primary string
+	ports := make(map[string]int32)
+	for _, name := range names {
+		for i := range subset.Ports {
+			if matchPort(&subset.Ports[i], name) {
+				ports[name] = subset.Ports[i].Port
+				if primary == "" {
+					primary = name
+				}
+			}
+		}
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+
+	metadata.Port = ports[primary]
+	metadata.Address = net.JoinHostPort(metadata.IP, strconv.Itoa(int(ports[primary])))
+	metadata.Ports = ports
+	return newKubernetesEndpoint(w.key(&metadata), metadata)
 }
 
 func (w *EndpointWatcher) makeEndpoints(subsets []corev1.EndpointSubset) []Endpoint {
 	var endpoints []Endpoint
 
-	servicePort, err := strconv.Atoi(w.Service.Port)
+	add := func(subset *corev1.EndpointSubset, address *corev1.EndpointAddress, ready bool) {
+		metadata := w.makeMetadata(address, ready)
 
-	for _, subset := range subsets {
-		for _, address := range subset.Addresses {
-			for _, port := range subset.Ports {
-				if (err == nil && servicePort == int(port.Port)) ||
-					(err != nil && w.Service.Port == port.Name) {
-					endpoints = append(endpoints, &kubernetesEndpoint{
-						Address: net.JoinHostPort(address.IP, strconv.Itoa(int(port.Port))),
-					})
-				}
+		if len(w.Ports) > 0 {
+			if endpoint := w.makeMultiPortEndpoint(subset, metadata); endpoint != nil {
+				endpoints = append(endpoints, endpoint)
+			}
+			return
+		}
+
+		for i := range subset.Ports {
+			port := &subset.Ports[i]
+			if matchPort(port, w.Service.Port) {
+				metadata := metadata
+				metadata.Address = net.JoinHostPort(address.IP, strconv.Itoa(int(port.Port)))
+				metadata.Port = port.Port
+				endpoints = append(endpoints, newKubernetesEndpoint(w.key(&metadata), metadata))
+			}
+		}
+	}
+
+	for i := range subsets {
+		subset := &subsets[i]
+		for j := range subset.Addresses {
+			add(subset, &subset.Addresses[j], true)
+		}
+		if w.NotReadyAddresses {
+			for j := range subset.NotReadyAddresses {
+				add(subset, &subset.NotReadyAddresses[j], false)
 			}
 		}
 	}
@@ -45,7 +326,166 @@ func (w *EndpointWatcher) makeEndpoints(subsets []corev1.EndpointSubset) []Endpo
 	return endpoints
 }
 
+// updateEndpoints updates in place the Endpoints already known with the
+// metadata of the new ones. The known Endpoints replace the new ones in
+// endpoints. It returns the Endpoints whose weight and labels have changed.
+func (w *EndpointWatcher) updateEndpoints(endpoints []Endpoint) (reweighted, relabeled []Endpoint) {
+
+	previous := make(map[string]*kubernetesEndpoint, len(w.previousEndpoints))
+	for _, endpoint := range w.previousEndpoints {
+		if e, ok := endpoint.(*kubernetesEndpoint); ok {
+			previous[e.Key()] = e
+		}
+	}
+
+	for i, endpoint := range endpoints {
+		e, ok := endpoint.(*kubernetesEndpoint)
+		if !ok {
+			continue
+		}
+		old, ok := previous[e.Key()]
+		if !ok {
+			continue
+		}
+		if old.Address() != e.Address() {
+			log.Debugf("watcher: update %s: %s -> %s", e.Key(), old.Address(), e.Address())
+		}
+		if old.Ready() != e.Ready() {
+			log.Debugf("watcher: update %s: ready=%t", e.Key(), e.Ready())
+		}
+		if old.Weight() != e.Weight() {
+			log.Debugf("watcher: update %s: weight=%d", e.Key(), e.Weight())
+			reweighted = append(reweighted, old)
+		}
+		if !equalLabels(old.Labels(), e.Labels()) {
+			log.Debugf("watcher: update %s: labels=%v", e.Key(), e.Labels())
+			relabeled = append(relabeled, old)
+		}
+		old.update(e.Metadata())
+		endpoints[i] = old
+	}
+
+	return reweighted, relabeled
+}
+
+// equalLabels returns true if a and b hold the same labels.
+func equalLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if value, ok := b[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// updateLabels gives the Endpoints whose labels have changed to the Receiver.
+func (w *EndpointWatcher) updateLabels(endpoints []Endpoint) {
+	if len(endpoints) == 0 {
+		return
+	}
+	if updater, ok := w.Receiver.(LabelUpdater); ok {
+		updater.UpdateLabels(endpoints...)
+	}
+}
+
+// updateWeights gives the Endpoints whose weight has changed to the Receiver.
+func (w *EndpointWatcher) updateWeights(endpoints []Endpoint) {
+	if len(endpoints) == 0 {
+		return
+	}
+	if updater, ok := w.Receiver.(WeightUpdater); ok {
+		updater.UpdateWeights(endpoints...)
+	}
+}
+
+// podUpdated updates the metadata of the Endpoints of pod: labels,
+// annotations and weight.
+func (w *EndpointWatcher) podUpdated(pod *corev1.Pod) {
+	w.Lock()
+	defer w.Unlock()
+
+	var reweighted, relabeled []Endpoint
+	for _, endpoint := range w.previousEndpoints {
+		e, ok := endpoint.(*kubernetesEndpoint)
+		if !ok {
+			continue
+		}
+		metadata := e.Metadata()
+		if metadata.PodName != pod.Name {
+			continue
+		}
+		previous := metadata
+		w.setPodMetadata(&metadata, pod)
+		e.update(metadata)
+		if metadata.Weight != previous.Weight {
+			log.Debugf("watcher: update %s: weight=%d", e.Key(), metadata.Weight)
+			reweighted = append(reweighted, e)
+		}
+		if !equalLabels(metadata.Labels, previous.Labels) {
+			log.Debugf("watcher: update %s: labels=%v", e.Key(), metadata.Labels)
+			relabeled = append(relabeled, e)
+		}
+	}
+
+	w.updateLabels(relabeled)
+	w.updateWeights(reweighted)
+}
+
+// newPodInformer creates an informer on the pods of the Service namespace to
+// follow changes of their labels, annotations and weight. Pods are then
+// retrieved from the informer cache.
+func (w *EndpointWatcher) newPodInformer(stop <-chan struct{}) cache.SharedIndexInformer {
+	pods := w.Client.CoreV1().Pods(w.Service.Namespace)
+
+	// Only the pods selected by the Service are cached. The selector is read
+	// again from the Service each time the pods are listed, watches use the
+	// selector of the last list.
+	var selector string
+	informer := cache.NewSharedIndexInformer(w.listWatch(&w.podStatus, stop,
+		func(options metav1.ListOptions) (runtime.Object, error) {
+			service, err := w.Client.CoreV1().Services(w.Service.Namespace).Get(w.Service.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			selector = labels.SelectorFromSet(service.Spec.Selector).String()
+			options.LabelSelector = selector
+			return pods.List(options)
+		},
+		func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return pods.Watch(options)
+		},
+	), &corev1.Pod{}, w.resync(), cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+
+	// Pods may be added to the cache after the Endpoints referencing them, eg.
+	// when they start matching the selector of the Service.
+	podChanged := func(obj interface{}) {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			w.podUpdated(pod)
+		}
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: podChanged,
+		UpdateFunc: func(_, obj interface{}) {
+			podChanged(obj)
+		},
+	})
+
+	return informer
+}
+
 func (w *EndpointWatcher) setEndpoints(endpoints []Endpoint) {
+	w.Lock()
+	defer w.Unlock()
+
+	var reweighted, relabeled []Endpoint
+	if w.KeyBy != KeyByAddress || w.NotReadyAddresses || w.needsPods() || len(w.Ports) > 0 {
+		reweighted, relabeled = w.updateEndpoints(endpoints)
+	}
+
 	for _, chunk := range difference(w.previousEndpoints, endpoints) {
 		switch chunk.operation {
 		case add:
@@ -57,63 +497,140 @@ func (w *EndpointWatcher) setEndpoints(endpoints []Endpoint) {
 		}
 	}
 
+	w.updateLabels(relabeled)
+	w.updateWeights(reweighted)
+
 	w.previousEndpoints = endpoints
 }
 
-func (w *EndpointWatcher) watchEvents(events watch.Interface, close <-chan interface{}) error {
-	select {
-	case <-close:
-		log.Info("stop watching endpoints")
-		return nil
-	case event := <-events.ResultChan():
-		switch event.Type {
-		case watch.Added:
-			fallthrough
-		case watch.Modified:
-			endpoints, ok := event.Object.(*corev1.Endpoints)
-			if !ok {
-				// Should never happen as it'd break the documented API contract.
-				return fmt.Errorf("could not cast a %s object to Endpoints", event.Object.GetObjectKind().GroupVersionKind().Kind)
-			}
-			newEndpoints := w.makeEndpoints(endpoints.Subsets)
-			w.setEndpoints(newEndpoints)
-		case watch.Deleted:
-			w.setEndpoints(nil)
-		case watch.Error:
-			status, ok := event.Object.(*metav1.Status)
-			if !ok {
-				// Should never happen as it'd break the documented API contract.
-				return fmt.Errorf("could not cast a %s object to Status", event.Object.GetObjectKind().GroupVersionKind().Kind)
-			}
-			return errors.FromObject(status)
-		}
+// endpointsUpdated gives the addresses of the Service Endpoints object to the
+// Receiver.
+func (w *EndpointWatcher) endpointsUpdated(obj interface{}) {
+	endpoints, ok := obj.(*corev1.Endpoints)
+	if !ok || endpoints.Name != w.Service.Name {
+		return
 	}
+	w.setEndpoints(w.makeEndpoints(endpoints.Subsets))
 
-	return nil
+	w.Lock()
+	w.synced = true
+	w.Unlock()
 }
 
-// Start will start an internal goroutine that watches the kubernetes service
-// and notify the Receiver of Endpoints changes.
-// close is a channel the caller can close to terminate this goroutine.
-func (w *EndpointWatcher) Start(close <-chan interface{}) {
-	// XXX: should we bubble up some of the errors to the library user?
-	go func() {
-		for {
-			events, err := w.Client.CoreV1().Endpoints(w.Service.Namespace).Watch(metav1.ListOptions{
-				FieldSelector: fmt.Sprintf("metadata.name=%s", w.Service.Name),
-			})
-			if err != nil {
-				log.Fatal(err)
-				return
-			}
+// endpointsDeleted removes all Endpoints from the Receiver when the Service
+// Endpoints object is deleted.
+func (w *EndpointWatcher) endpointsDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	endpoints, ok := obj.(*corev1.Endpoints)
+	if !ok || endpoints.Name != w.Service.Name {
+		return
+	}
+	w.setEndpoints(nil)
+}
 
-			err = w.watchEvents(events, close)
-			events.Stop()
-			if err != nil {
-				log.Error(err)
-				// XXX we may need to reconnect the Kubernetes client.
-				time.Sleep(time.Second)
-			}
+// resync returns the resync period of informers.
+func (w *EndpointWatcher) resync() time.Duration {
+	if w.Resync == 0 {
+		return defaultResync
+	}
+	return w.Resync
+}
+
+// newEndpointsInformer creates an informer on the Endpoints object of the
+// Service. The informer lists the object before watching it, resumes watches
+// from the last resourceVersion seen and relists when it's too old.
+func (w *EndpointWatcher) newEndpointsInformer(stop <-chan struct{}) cache.SharedIndexInformer {
+	endpoints := w.Client.CoreV1().Endpoints(w.Service.Namespace)
+	selector := fields.OneTermEqualSelector("metadata.name", w.Service.Name).String()
+
+	informer := cache.NewSharedIndexInformer(w.listWatch(&w.status, stop,
+		func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return endpoints.List(options)
+		},
+		func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return endpoints.Watch(options)
+		},
+	), &corev1.Endpoints{}, w.resync(), cache.Indexers{})
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: w.endpointsUpdated,
+		UpdateFunc: func(_, obj interface{}) {
+			w.endpointsUpdated(obj)
+		},
+		DeleteFunc: w.endpointsDeleted,
+	})
+
+	return informer
+}
+
+// HasSynced returns true once the watcher has given the initial list of
+// Endpoints to the Receiver, or has found the Service doesn't have any.
+func (w *EndpointWatcher) HasSynced() bool {
+	w.Lock()
+	informer, podInformer, synced := w.informer, w.podInformer, w.synced
+	w.Unlock()
+
+	if informer == nil || !informer.HasSynced() {
+		return false
+	}
+	if podInformer != nil && !podInformer.HasSynced() {
+		return false
+	}
+	// The Endpoints object is handed to the Receiver asynchronously.
+	return synced || len(informer.GetStore().ListKeys()) == 0
+}
+
+// Start will start internal goroutines that watch the kubernetes service and
+// notify the Receiver of Endpoints changes. Start doesn't wait for the
+// Endpoints to be known, see HasSynced. The goroutines terminate when ctx is
+// done, see Wait.
+//
+// When pod labels, annotations or weights are needed, the pods selected by the
+// Service are watched as well. Services without a selector have all the pods
+// of their namespace watched.
+func (w *EndpointWatcher) Start(ctx context.Context) {
+	stop := ctx.Done()
+
+	var podInformer cache.SharedIndexInformer
+	if w.needsPods() {
+		podInformer = w.newPodInformer(stop)
+		w.pods = corelisters.NewPodLister(podInformer.GetIndexer())
+		w.run(podInformer, stop)
+	}
+
+	informer := w.newEndpointsInformer(stop)
+	w.Lock()
+	w.informer = informer
+	w.podInformer = podInformer
+	w.Unlock()
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		// Endpoints are built from the pods in the cache, fill it first.
+		if podInformer != nil && !cache.WaitForCacheSync(stop, podInformer.HasSynced) {
+			return
 		}
+		informer.Run(stop)
+		log.Info("watcher: stop watching endpoints")
+	}()
+}
+
+// run runs informer until stop is closed.
+func (w *EndpointWatcher) run(informer cache.SharedIndexInformer, stop <-chan struct{}) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		informer.Run(stop)
 	}()
 }
+
+// Wait blocks until the goroutines started by Start have terminated, once the
+// context given to Start is done.
+func (w *EndpointWatcher) Wait() {
+	w.wg.Wait()
+}
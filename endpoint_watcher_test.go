@@ -0,0 +1,389 @@
+package balance
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func TestMakeEndpointsMetadata(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "db-0",
+				Labels:      map[string]string{"version": "v1"},
+				Annotations: map[string]string{"team": "storage"},
+			},
+		},
+		&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "node-1",
+				Labels: map[string]string{"topology.kubernetes.io/zone": "zone-a"},
+			},
+		},
+	)
+	w := &EndpointWatcher{
+		Client:         client,
+		Service:        Service{Namespace: "default", Name: "db", Port: "8080"},
+		PodLabels:      true,
+		PodAnnotations: true,
+		Zones:          true,
+	}
+
+	node := "node-1"
+	endpoints := w.makeEndpoints([]corev1.EndpointSubset{{
+		Addresses: []corev1.EndpointAddress{{
+			IP:       "10.0.0.1",
+			Hostname: "db-0",
+			NodeName: &node,
+			TargetRef: &corev1.ObjectReference{
+				Kind:      "Pod",
+				Namespace: "default",
+				Name:      "db-0",
+				UID:       "1234",
+			},
+		}},
+		Ports: []corev1.EndpointPort{{Port: 8080}, {Port: 9090}},
+	}})
+
+	assert.Len(t, endpoints, 1)
+	assert.Equal(t, EndpointMetadata{
+		Address:  "10.0.0.1:8080",
+		IP:       "10.0.0.1",
+		Port:     8080,
+		Hostname: "db-0",
+		NodeName: "node-1",
+		Zone:     "zone-a",
+		TargetRef: &ObjectReference{
+			Kind:      "Pod",
+			Namespace: "default",
+			Name:      "db-0",
+			UID:       "1234",
+		},
+		PodName:     "db-0",
+		Labels:      map[string]string{"version": "v1"},
+		Annotations: map[string]string{"team": "storage"},
+		Ready:       true,
+	}, endpoints[0].(Described).Metadata())
+	assert.Equal(t, map[string]string{"version": "v1"}, endpoints[0].(Labeled).Labels())
+}
+
+// recorder is an EndpointSet recording the Endpoints it holds.
+type recorder struct {
+	endpoints map[string]Endpoint
+}
+
+func (r *recorder) AddEndpoints(endpoints ...Endpoint) {
+	for _, endpoint := range endpoints {
+		r.endpoints[endpoint.Key()] = endpoint
+	}
+}
+
+func (r *recorder) RemoveEndpoints(endpoints ...Endpoint) {
+	for _, endpoint := range endpoints {
+		delete(r.endpoints, endpoint.Key())
+	}
+}
+
+func statefulSubset(ip string) []corev1.EndpointSubset {
+	return []corev1.EndpointSubset{{
+		Addresses: []corev1.EndpointAddress{{
+			IP:        ip,
+			Hostname:  "db-2",
+			TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "db-2"},
+		}},
+		Ports: []corev1.EndpointPort{{Port: 8080}},
+	}}
+}
+
+func TestKeyByPodName(t *testing.T) {
+	r := &recorder{endpoints: make(map[string]Endpoint)}
+	w := &EndpointWatcher{
+		Service:  Service{Namespace: "default", Name: "db", Port: "8080"},
+		Receiver: r,
+		KeyBy:    KeyByPodName,
+	}
+
+	w.setEndpoints(w.makeEndpoints(statefulSubset("10.0.0.1")))
+	endpoint := r.endpoints["db-2:8080"]
+	assert.NotNil(t, endpoint)
+	assert.Equal(t, "10.0.0.1:8080", Address(endpoint))
+
+	// The pod restarts with a new IP, the Endpoint is updated in place.
+	w.setEndpoints(w.makeEndpoints(statefulSubset("10.0.0.2")))
+	assert.Len(t, r.endpoints, 1)
+	assert.True(t, endpoint == r.endpoints["db-2:8080"])
+	assert.Equal(t, "10.0.0.2:8080", Address(endpoint))
+}
+
+func TestNotReadyAddresses(t *testing.T) {
+	r := &recorder{endpoints: make(map[string]Endpoint)}
+	w := &EndpointWatcher{
+		Service:           Service{Namespace: "default", Name: "db", Port: "8080"},
+		Receiver:          r,
+		NotReadyAddresses: true,
+	}
+
+	address := corev1.EndpointAddress{IP: "10.0.0.1"}
+	ports := []corev1.EndpointPort{{Port: 8080}}
+
+	w.setEndpoints(w.makeEndpoints([]corev1.EndpointSubset{{
+		Addresses: []corev1.EndpointAddress{address},
+		Ports:     ports,
+	}}))
+	endpoint := r.endpoints["10.0.0.1:8080"]
+	assert.True(t, endpoint.(Readiness).Ready())
+
+	// The endpoint stays known while not ready.
+	w.setEndpoints(w.makeEndpoints([]corev1.EndpointSubset{{
+		NotReadyAddresses: []corev1.EndpointAddress{address},
+		Ports:             ports,
+	}}))
+	assert.True(t, endpoint == r.endpoints["10.0.0.1:8080"])
+	assert.False(t, endpoint.(Readiness).Ready())
+
+	// Not ready addresses are ignored by default.
+	w.NotReadyAddresses = false
+	w.setEndpoints(w.makeEndpoints([]corev1.EndpointSubset{{
+		NotReadyAddresses: []corev1.EndpointAddress{address},
+		Ports:             ports,
+	}}))
+	assert.Empty(t, r.endpoints)
+}
+
+func TestMultiPortEndpoints(t *testing.T) {
+	w := &EndpointWatcher{
+		Service: Service{Namespace: "default", Name: "db", Port: "http"},
+		Ports:   []string{"metrics", "9999"},
+	}
+
+	endpoints := w.makeEndpoints([]corev1.EndpointSubset{{
+		Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+		Ports: []corev1.EndpointPort{
+			{Name: "http", Port: 8080},
+			{Name: "metrics", Port: 9090},
+			{Name: "admin", Port: 9091},
+		},
+	}})
+
+	// One Endpoint per address, with all the watched ports.
+	assert.Len(t, endpoints, 2)
+	assert.Equal(t, "10.0.0.1", endpoints[0].Key())
+	metadata := endpoints[0].(Described).Metadata()
+	assert.Equal(t, "10.0.0.1:8080", metadata.Address)
+	assert.Equal(t, map[string]int32{"http": 8080, "metrics": 9090}, metadata.Ports)
+
+	address, ok := PortAddress(endpoints[0], "metrics")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1:9090", address)
+	_, ok = PortAddress(endpoints[0], "9999")
+	assert.False(t, ok)
+}
+
+// TestIPv6Endpoints checks IPv6 addresses are bracketed in Endpoint keys.
+func TestIPv6Endpoints(t *testing.T) {
+	subsets := []corev1.EndpointSubset{{
+		Addresses: []corev1.EndpointAddress{
+			{IP: "fd00::1"},
+			{IP: "fd00::2"},
+		},
+		Ports: []corev1.EndpointPort{{Port: 8080}},
+	}}
+
+	w := &EndpointWatcher{Service: Service{Namespace: "default", Name: "db", Port: "8080"}}
+	endpoints := w.makeEndpoints(subsets)
+	assert.Equal(t, []string{"[fd00::1]:8080", "[fd00::2]:8080"}, keys(endpoints))
+	assert.Equal(t, "fd00::1", endpoints[0].(Described).Metadata().IP)
+}
+
+// waitFor polls condition until it's true or 5 seconds have passed.
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 500; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestWatcherStart(t *testing.T) {
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []corev1.EndpointPort{{Port: 8080}},
+		}},
+	}
+	client := fake.NewSimpleClientset(endpoints)
+	r := &recorder{endpoints: make(map[string]Endpoint)}
+	w := &EndpointWatcher{
+		Client:   client,
+		Service:  Service{Namespace: "default", Name: "db", Port: "8080"},
+		Receiver: r,
+	}
+	keys := func() []string {
+		w.Lock()
+		defer w.Unlock()
+		var keys []string
+		for key := range r.endpoints {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.False(t, w.HasSynced())
+	w.Start(ctx)
+
+	// The initial list is given to the Receiver before HasSynced is true.
+	assert.True(t, waitFor(w.HasSynced))
+	assert.Equal(t, []string{"10.0.0.1:8080"}, keys())
+
+	// Changes are watched.
+	endpoints.Subsets[0].Addresses = append(endpoints.Subsets[0].Addresses, corev1.EndpointAddress{IP: "10.0.0.2"})
+	_, err := client.CoreV1().Endpoints("default").Update(endpoints)
+	assert.NoError(t, err)
+	assert.True(t, waitFor(func() bool { return len(keys()) == 2 }))
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, keys())
+
+	err = client.CoreV1().Endpoints("default").Delete("db", &metav1.DeleteOptions{})
+	assert.NoError(t, err)
+	assert.True(t, waitFor(func() bool { return len(keys()) == 0 }))
+
+	cancel()
+	w.Wait()
+}
+
+func TestWatcherRelabel(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "db-2",
+			Labels:    map[string]string{"version": "v1"},
+		},
+	}
+	client := fake.NewSimpleClientset(pod)
+	v1 := NewConsistent(ConsistentConfig{})
+	v2 := NewConsistent(ConsistentConfig{})
+	router := NewSubsetRouter(SubsetRouterConfig{
+		Default: Subset{Selector: map[string]string{"version": "v1"}, Algorithm: v1},
+		Subsets: map[string]Subset{
+			"v2": {Selector: map[string]string{"version": "v2"}, Algorithm: v2},
+		},
+	})
+	w := &EndpointWatcher{
+		Client:            client,
+		Service:           Service{Namespace: "default", Name: "db", Port: "8080"},
+		Receiver:          router,
+		PodLabels:         true,
+		NotReadyAddresses: true,
+	}
+
+	w.setEndpoints(w.makeEndpoints(statefulSubset("10.0.0.1")))
+	assert.Equal(t, 1, v1.numEndpoints)
+
+	// The pod is relabeled, the Endpoint moves to the v2 subset.
+	pod.Labels = map[string]string{"version": "v2"}
+	_, err := client.CoreV1().Pods("default").Update(pod)
+	assert.NoError(t, err)
+	w.setEndpoints(w.makeEndpoints(statefulSubset("10.0.0.1")))
+	assert.Equal(t, 0, v1.numEndpoints)
+	assert.Equal(t, 1, v2.numEndpoints)
+
+	// And the pod is deleted.
+	w.setEndpoints(nil)
+	assert.Equal(t, 0, v1.numEndpoints)
+	assert.Equal(t, 0, v2.numEndpoints)
+	assert.Nil(t, v1.Get("foo"))
+}
+
+// dbService is the Service in front of the db pods.
+func dbService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "db"},
+		},
+	}
+}
+
+func TestWatcherPodInformer(t *testing.T) {
+	client := fake.NewSimpleClientset(dbService(), &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Subsets:    statefulSubset("10.0.0.1"),
+	}, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "web-0",
+			Labels:    map[string]string{"app": "web"},
+		},
+	})
+	v1 := NewConsistent(ConsistentConfig{})
+	v2 := NewConsistent(ConsistentConfig{})
+	w := &EndpointWatcher{
+		Client:  client,
+		Service: Service{Namespace: "default", Name: "db", Port: "8080"},
+		Receiver: NewSubsetRouter(SubsetRouterConfig{
+			Default: Subset{Selector: map[string]string{"version": "v1"}, Algorithm: v1},
+			Subsets: map[string]Subset{
+				"v2": {Selector: map[string]string{"version": "v2"}, Algorithm: v2},
+			},
+		}),
+		PodLabels: true,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		w.Wait()
+	}()
+	w.Start(ctx)
+	assert.True(t, waitFor(w.HasSynced))
+
+	// Only the pods selected by the Service are watched.
+	for _, action := range client.Actions() {
+		if list, ok := action.(ktesting.ListAction); ok && action.GetResource().Resource == "pods" {
+			assert.Equal(t, "app=db", list.GetListRestrictions().Labels.String())
+		}
+	}
+	_, err := w.pods.Pods("default").Get("web-0")
+	assert.Error(t, err)
+
+	// The pod shows up after its Endpoint, its labels are given once it's
+	// added to the cache.
+	assert.Equal(t, 0, v1.numEndpoints)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "db-2",
+			Labels:    map[string]string{"app": "db", "version": "v1"},
+		},
+	}
+	_, err = client.CoreV1().Pods("default").Create(pod)
+	assert.NoError(t, err)
+	assert.True(t, waitFor(func() bool { return v1.Get("foo") != nil }))
+
+	// Pods come from the informer cache, not from the API server.
+	for _, action := range client.Actions() {
+		if action.GetResource().Resource == "pods" {
+			assert.NotEqual(t, "get", action.GetVerb(), "%v", action)
+		}
+	}
+
+	// Relabeling the pod moves the Endpoint without any Endpoints change.
+	pod.Labels = map[string]string{"app": "db", "version": "v2"}
+	_, err = client.CoreV1().Pods("default").Update(pod)
+	assert.NoError(t, err)
+	assert.True(t, waitFor(func() bool { return v2.Get("foo") != nil }))
+	assert.Nil(t, v1.Get("foo"))
+}
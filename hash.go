@@ -0,0 +1,233 @@
+package balance
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+	"sort"
+)
+
+// Built-in hash functions, selectable by name with HashByName.
+var hashes = map[string]Hash64{
+	"crc32": Hash32To64(crc32.ChecksumIEEE),
+	// The high bits of FNV-1a barely depend on the last bytes of the input,
+	// which matters a lot for a hash ring. Add a final avalanche step.
+	"fnv1a": func(data []byte) uint64 {
+		return murmurFmix(FNV1a(data))
+	},
+	"murmur3": Murmur3,
+	"xxhash":  XXHash,
+}
+
+// hashBits returns the width of the values of the built-in hash function
+// called name.
+func hashBits(name string) uint {
+	if name == "crc32" {
+		return 32
+	}
+	return 64
+}
+
+// HashNames returns the names of the built-in hash functions.
+func HashNames() []string {
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HashByName returns the built-in hash function called name. See HashNames
+// for the list of valid names.
+func HashByName(name string) (Hash64, error) {
+	hash, ok := hashes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash function: %s", name)
+	}
+	return hash, nil
+}
+
+// Hash32To64 turns a 32-bit hash function into a Hash64. Hash values are
+// unchanged.
+func Hash32To64(hash Hash) Hash64 {
+	return func(data []byte) uint64 {
+		return uint64(hash(data))
+	}
+}
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// FNV1a is the 64-bit FNV-1a hash function.
+//
+// Beware that the high bits of FNV-1a don't depend much on the last bytes of
+// the input: keys differing only by their last characters end up close to
+// each other on a hash ring. The "fnv1a" hash returned by HashByName doesn't
+// have this issue.
+func FNV1a(data []byte) uint64 {
+	// Same as hash/fnv, without the allocation.
+	var h uint64 = fnvOffset64
+	for _, b := range data {
+		h ^= uint64(b)
+		h *= fnvPrime64
+	}
+	return h
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// XXHash is the 64-bit xxHash hash function (XXH64), with a seed of 0.
+//
+// See https://github.com/Cyan4973/xxHash.
+func XXHash(data []byte) uint64 {
+	n := len(data)
+	var h uint64
+
+	if n >= 32 {
+		// Use variables, the seeds are meant to wrap around.
+		prime1, prime2 := xxPrime1, xxPrime2
+		v1 := prime1 + prime2
+		v2 := prime2
+		v3 := uint64(0)
+		v4 := -prime1
+		for len(data) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[24:32]))
+			data = data[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+
+	h += uint64(n)
+
+	for ; len(data) >= 8; data = data[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(data))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for _, b := range data {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+
+	return h
+}
+
+const (
+	murmurC1 uint64 = 0x87c37b91114253d5
+	murmurC2 uint64 = 0x4cf5ad432745937f
+)
+
+func murmurFmix(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+// Murmur3 is the first 64 bits of the x64 128-bit variant of MurmurHash3, with
+// a seed of 0.
+//
+// See https://github.com/aappleby/smhasher.
+func Murmur3(data []byte) uint64 {
+	n := len(data)
+	var h1, h2 uint64
+
+	for ; len(data) >= 16; data = data[16:] {
+		k1 := binary.LittleEndian.Uint64(data[0:8])
+		k2 := binary.LittleEndian.Uint64(data[8:16])
+
+		k1 *= murmurC1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= murmurC2
+		h1 ^= k1
+		h1 = bits.RotateLeft64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+
+		k2 *= murmurC2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= murmurC1
+		h2 ^= k2
+		h2 = bits.RotateLeft64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+
+	// Tail.
+	var k1, k2 uint64
+	for i := len(data) - 1; i >= 8; i-- {
+		k2 ^= uint64(data[i]) << (uint(i-8) * 8)
+	}
+	if len(data) > 8 {
+		k2 *= murmurC2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= murmurC1
+		h2 ^= k2
+	}
+	tail := len(data)
+	if tail > 8 {
+		tail = 8
+	}
+	for i := tail - 1; i >= 0; i-- {
+		k1 ^= uint64(data[i]) << (uint(i) * 8)
+	}
+	if len(data) > 0 {
+		k1 *= murmurC1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= murmurC2
+		h1 ^= k1
+	}
+
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+	h1 += h2
+	h2 += h1
+	h1 = murmurFmix(h1)
+	h2 = murmurFmix(h2)
+	h1 += h2
+
+	return h1
+}
@@ -0,0 +1,71 @@
+package balance
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashFunctions(t *testing.T) {
+	tests := []struct {
+		input                  string
+		fnv1a, murmur3, xxhash uint64
+	}{
+		{"", 0xcbf29ce484222325, 0x0000000000000000, 0xef46db3751d8e999},
+		{"a", 0xaf63dc4c8601ec8c, 0x85555565f6597889, 0xd24ec4f1a98c6e5b},
+		{"user-42", 0x32c6d7a54d35dacb, 0x4d32de269f8ffaa2, 0x397e9d3a76af7c81},
+		{"The quick brown fox jumps over the lazy dog", 0xf3f9b7f5e7e47110, 0xe34bbc7bbc071b6c, 0x0b242d361fda71bc},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.fnv1a, FNV1a([]byte(test.input)), "fnv1a(%q)", test.input)
+		assert.Equal(t, test.murmur3, Murmur3([]byte(test.input)), "murmur3(%q)", test.input)
+		assert.Equal(t, test.xxhash, XXHash([]byte(test.input)), "xxhash(%q)", test.input)
+	}
+}
+
+func TestHashByName(t *testing.T) {
+	assert.Equal(t, []string{"crc32", "fnv1a", "murmur3", "xxhash"}, HashNames())
+
+	for _, name := range HashNames() {
+		hash, err := HashByName(name)
+		assert.NoError(t, err)
+		assert.NotNil(t, hash)
+	}
+
+	_, err := HashByName("md5")
+	assert.Error(t, err)
+}
+
+func TestConsistentHashName(t *testing.T) {
+	assert.Nil(t, NewConsistent(ConsistentConfig{HashName: "md5"}))
+
+	for _, name := range HashNames() {
+		hash := NewConsistent(ConsistentConfig{HashName: name})
+		for i := 0; i < 4; i++ {
+			hash.AddEndpoints(e(fmt.Sprintf("10.0.0.%d:8080", i)))
+		}
+
+		// All endpoints should get keys.
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			seen[hash.Get(fmt.Sprintf("user-%d", i)).Key()] = true
+		}
+		assert.Len(t, seen, 4, "hash %s", name)
+	}
+}
+
+func TestConsistentHash64(t *testing.T) {
+	// 64-bit hashes take precedence over 32-bit ones.
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 1,
+		Hash:             testHash,
+		Hash64: func(data []byte) uint64 {
+			return uint64(testHash(data)) << 32
+		},
+	})
+	hash.AddEndpoints(e("2"), e("4"))
+	assert.Equal(t, []int{2 << 32, 4 << 32}, ringHashes(hash))
+	assert.Equal(t, "4", hash.Get("3").Key())
+}
@@ -0,0 +1,293 @@
+package balance
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultHotKeyWindow = 10 * time.Second
+	defaultHotKeySpread = 3
+	defaultHotKeyTopK   = 16
+
+	sketchDepth = 4
+	sketchWidth = 1024
+)
+
+// HotKeyConfig configures the detection of hot keys, keys receiving a
+// disproportionate number of requests. Requests for hot keys are spread across
+// a small set of Endpoints instead of all landing on the same Endpoint.
+//
+// Hot key detection adds a hash and a few atomic increments to each Get. A lock
+// is only taken when a window ends and when a key becomes hot.
+type HotKeyConfig struct {
+	// Threshold is the number of requests over Window above which a key is
+	// considered hot. Hot key detection is disabled when Threshold is 0.
+	Threshold int
+
+	// Window is the duration of the sliding window requests are counted over.
+	// Defaults to 10s.
+	Window time.Duration
+
+	// Spread is the number of distinct Endpoints, following the key position on
+	// the hash ring, requests for a hot key are spread across.
+	// Defaults to 3.
+	Spread int
+
+	// TopK is the maximum number of hot keys tracked at any given time. When
+	// more keys are hot, the hottest ones are kept.
+	// Defaults to 16.
+	TopK int
+}
+
+// countMinSketch is a count-min sketch, an approximate frequency table using
+// a fixed amount of memory. Estimates are never lower than the real counts.
+// Counters are updated atomically, a sketch can be used concurrently.
+type countMinSketch struct {
+	counts [sketchDepth][sketchWidth]uint32
+}
+
+// indexes returns the counter indexes of key, one per row.
+func (s *countMinSketch) indexes(key string) [sketchDepth]uint32 {
+	sum := XXHash([]byte(key))
+
+	// Derive the row hashes from two halves of a 64-bit hash, see "Less Hashing,
+	// Same Performance: Building a Better Bloom Filter" by Kirsch and Mitzenmacher.
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	var idx [sketchDepth]uint32
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) % sketchWidth
+	}
+	return idx
+}
+
+// add increments the count of key and returns its new estimate.
+func (s *countMinSketch) add(key string) uint32 {
+	var min uint32 = ^uint32(0)
+	for row, i := range s.indexes(key) {
+		if count := atomic.AddUint32(&s.counts[row][i], 1); count < min {
+			min = count
+		}
+	}
+	return min
+}
+
+// estimate returns the estimated count of key.
+func (s *countMinSketch) estimate(key string) uint32 {
+	var min uint32 = ^uint32(0)
+	for row, i := range s.indexes(key) {
+		if count := atomic.LoadUint32(&s.counts[row][i]); count < min {
+			min = count
+		}
+	}
+	return min
+}
+
+// hotKey is a key detected as hot.
+type hotKey struct {
+	requests uint64 // estimated number of requests over the window, float64 bits, atomic
+	next     uint32 // round-robin index into the spread Endpoints, atomic
+}
+
+func (hk *hotKey) getRequests() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&hk.requests))
+}
+
+func (hk *hotKey) setRequests(requests float64) {
+	atomic.StoreUint64(&hk.requests, math.Float64bits(requests))
+}
+
+// hotKeyWindow holds the counts of the current and previous windows. A new
+// hotKeyWindow is created when the current window is over, so concurrent
+// observers never see sketches being reset.
+type hotKeyWindow struct {
+	start    time.Time
+	current  *countMinSketch
+	previous *countMinSketch
+}
+
+// hotKeyDetector counts requests per key over a sliding window and keeps track
+// of the top-K hottest keys.
+//
+// The sliding window is approximated with two sketches: the current window and
+// the previous one, the latter weighted by how much of it still overlaps with
+// the sliding window.
+//
+// Requests are counted without locking. The window and the hot keys are
+// replaced, not modified, under the lock when a window ends or a key becomes
+// hot.
+type hotKeyDetector struct {
+	sync.Mutex
+	name   string
+	config HotKeyConfig
+	now    func() time.Time
+	window atomic.Value         // *hotKeyWindow
+	hot    atomic.Value         // map[string]*hotKey, read-only
+	gauge  *prometheus.GaugeVec // Estimated requests per hot key
+}
+
+// valid returns false if config has negative values.
+func (config *HotKeyConfig) valid() bool {
+	return config.Window >= 0 && config.Spread >= 0 && config.TopK >= 0
+}
+
+func newHotKeyDetector(name string, config HotKeyConfig, gauge *prometheus.GaugeVec) *hotKeyDetector {
+	if config.Threshold <= 0 {
+		return nil
+	}
+	if config.Window == 0 {
+		config.Window = defaultHotKeyWindow
+	}
+	if config.Spread == 0 {
+		config.Spread = defaultHotKeySpread
+	}
+	if config.TopK == 0 {
+		config.TopK = defaultHotKeyTopK
+	}
+
+	d := &hotKeyDetector{
+		name:   name,
+		config: config,
+		now:    time.Now,
+		gauge:  gauge,
+	}
+	d.window.Store(&hotKeyWindow{
+		start:    d.now(),
+		current:  &countMinSketch{},
+		previous: &countMinSketch{},
+	})
+	d.hot.Store(make(map[string]*hotKey))
+	return d
+}
+
+// hotKeys returns the keys currently hot. The map must not be modified.
+func (d *hotKeyDetector) hotKeys() map[string]*hotKey {
+	return d.hot.Load().(map[string]*hotKey)
+}
+
+// requests returns the estimated number of requests for key over the sliding
+// window, given the current count of key.
+func (d *hotKeyDetector) requests(w *hotKeyWindow, key string, current uint32, now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(w.start))/float64(d.config.Window)
+	// now may be slightly off the window when racing with a rotation.
+	overlap = math.Max(0, math.Min(1, overlap))
+	return float64(current) + overlap*float64(w.previous.estimate(key))
+}
+
+// rotate starts a new window if the current one is over and returns the
+// window to count requests in.
+func (d *hotKeyDetector) rotate(now time.Time) *hotKeyWindow {
+	d.Lock()
+	defer d.Unlock()
+
+	w := d.window.Load().(*hotKeyWindow)
+	elapsed := now.Sub(w.start)
+	if elapsed < d.config.Window {
+		// Another observer got there first.
+		return w
+	}
+
+	next := &hotKeyWindow{
+		start:    now.Add(-(elapsed % d.config.Window)),
+		current:  &countMinSketch{},
+		previous: w.current,
+	}
+	if elapsed >= 2*d.config.Window {
+		// We haven't seen any request for a full window.
+		next.previous = &countMinSketch{}
+	}
+	d.window.Store(next)
+
+	// Re-evaluate hot keys against the new window.
+	hot := make(map[string]*hotKey)
+	for key, hk := range d.hotKeys() {
+		requests := d.requests(next, key, 0, now)
+		if requests < float64(d.config.Threshold) {
+			d.gauge.DeleteLabelValues(d.name, key)
+			continue
+		}
+		hk.setRequests(requests)
+		hot[key] = hk
+		d.gauge.WithLabelValues(d.name, key).Set(requests)
+	}
+	d.hot.Store(hot)
+
+	return next
+}
+
+// coldest returns the hot key with the lowest estimated number of requests.
+func coldest(hot map[string]*hotKey) (key string, requests float64) {
+	for k, hk := range hot {
+		if r := hk.getRequests(); key == "" || r < requests {
+			key, requests = k, r
+		}
+	}
+	return key, requests
+}
+
+// heat adds key to the hot keys, evicting the coldest hot key if there are
+// already TopK of them and key is hotter. It returns nil if key isn't added.
+func (d *hotKeyDetector) heat(key string, requests float64) *hotKey {
+	// Don't take the lock for keys that wouldn't make it to the top-K.
+	if hot := d.hotKeys(); len(hot) >= d.config.TopK {
+		if _, min := coldest(hot); min >= requests {
+			return nil
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	previous := d.hotKeys()
+	if hk, ok := previous[key]; ok {
+		return hk
+	}
+
+	hot := make(map[string]*hotKey, len(previous)+1)
+	for k, hk := range previous {
+		hot[k] = hk
+	}
+	if len(previous) >= d.config.TopK {
+		// Evict the coldest hot key if the new one is hotter.
+		evicted, min := coldest(previous)
+		if min >= requests {
+			return nil
+		}
+		delete(hot, evicted)
+		d.gauge.DeleteLabelValues(d.name, evicted)
+	}
+
+	hk := &hotKey{}
+	hk.setRequests(requests)
+	hot[key] = hk
+	d.hot.Store(hot)
+	d.gauge.WithLabelValues(d.name, key).Set(requests)
+	return hk
+}
+
+// observe accounts for a new request for key. It returns the hotKey entry when
+// key is hot, nil otherwise.
+func (d *hotKeyDetector) observe(key string) *hotKey {
+	now := d.now()
+	w := d.window.Load().(*hotKeyWindow)
+	if now.Sub(w.start) >= d.config.Window {
+		w = d.rotate(now)
+	}
+
+	requests := d.requests(w, key, w.current.add(key), now)
+
+	if hk, ok := d.hotKeys()[key]; ok {
+		hk.setRequests(requests)
+		return hk
+	}
+
+	if requests < float64(d.config.Threshold) {
+		return nil
+	}
+
+	return d.heat(key, requests)
+}
@@ -0,0 +1,161 @@
+package balance
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	s := &countMinSketch{}
+
+	for i := 0; i < 100; i++ {
+		s.add("hot")
+	}
+	for i := 0; i < 1000; i++ {
+		s.add(fmt.Sprintf("cold-%d", i))
+	}
+
+	// Estimates are never lower than the real count.
+	assert.True(t, s.estimate("hot") >= 100)
+	assert.True(t, s.estimate("hot") < 110)
+	assert.True(t, s.estimate("cold-0") >= 1)
+	assert.Equal(t, uint32(0), s.estimate("unknown"))
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+// setClock makes d use clock, starting a window at the current time.
+func setClock(d *hotKeyDetector, clock *fakeClock) {
+	d.now = clock.now
+	d.window.Store(&hotKeyWindow{
+		start:    clock.now(),
+		current:  &countMinSketch{},
+		previous: &countMinSketch{},
+	})
+}
+
+func TestHotKeyDetector(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	d := newHotKeyDetector("test", HotKeyConfig{
+		Threshold: 10,
+		Window:    time.Second,
+		TopK:      2,
+	}, testMetricVecs().hotKeyRequests)
+	setClock(d, clock)
+
+	for i := 0; i < 9; i++ {
+		assert.Nil(t, d.observe("a"))
+	}
+	for i := 0; i < 11; i++ {
+		assert.NotNil(t, d.observe("a"))
+	}
+
+	// Half way through the next window, only half of the previous window counts.
+	clock.t = clock.t.Add(1500 * time.Millisecond)
+	assert.NotNil(t, d.observe("a"))
+	assert.InDelta(t, 11, d.hotKeys()["a"].getRequests(), 0.001)
+
+	// Two full windows without requests cool the key down.
+	clock.t = clock.t.Add(2 * time.Second)
+	assert.Nil(t, d.observe("a"))
+	assert.Empty(t, d.hotKeys())
+}
+
+func TestHotKeyDetectorTopK(t *testing.T) {
+	d := newHotKeyDetector("test", HotKeyConfig{
+		Threshold: 2,
+		TopK:      2,
+	}, testMetricVecs().hotKeyRequests)
+
+	observe := func(key string, n int) {
+		for i := 0; i < n; i++ {
+			d.observe(key)
+		}
+	}
+
+	observe("a", 3)
+	observe("b", 2)
+	observe("c", 2)
+	// c isn't hotter than b, it's not tracked.
+	assert.Len(t, d.hotKeys(), 2)
+	assert.Nil(t, d.hotKeys()["c"])
+
+	// c is now hotter than b and takes its place.
+	observe("c", 2)
+	assert.Len(t, d.hotKeys(), 2)
+	assert.NotNil(t, d.hotKeys()["a"])
+	assert.NotNil(t, d.hotKeys()["c"])
+}
+
+func TestHotKeyDetectorConcurrent(t *testing.T) {
+	d := newHotKeyDetector("test", HotKeyConfig{
+		Threshold: 100,
+		Window:    time.Millisecond,
+		TopK:      2,
+	}, testMetricVecs().hotKeyRequests)
+
+	// Windows rotate and keys become hot while requests are observed.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				d.observe("hot")
+				d.observe(fmt.Sprintf("cold-%d-%d", i, j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.True(t, len(d.hotKeys()) <= 2)
+}
+
+func TestHotKeySpread(t *testing.T) {
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 3,
+		Hash:             testHash,
+		HotKeys: HotKeyConfig{
+			Threshold: 2,
+			Spread:    2,
+		},
+	})
+	hash.AddEndpoints(e("6"), e("4"), e("2"))
+
+	// 11 maps to 2, the next endpoint on the ring is 4.
+	assert.Equal(t, "2", hash.Get("11").Key())
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[hash.Get("11").Key()]++
+	}
+	assert.Equal(t, map[string]int{"2": 5, "4": 5}, counts)
+}
+
+func TestHotKeyConfigInvalid(t *testing.T) {
+	assert.Nil(t, NewConsistent(ConsistentConfig{HotKeys: HotKeyConfig{Threshold: 2, Spread: -1}}))
+	assert.Nil(t, NewConsistent(ConsistentConfig{HotKeys: HotKeyConfig{Threshold: 2, TopK: -1}}))
+	assert.Nil(t, NewConsistent(ConsistentConfig{HotKeys: HotKeyConfig{Threshold: 2, Window: -time.Second}}))
+}
+
+func TestHotKeySpreadBoundedLoad(t *testing.T) {
+	hash := makeTestHash(1.25, boundedState{
+		{"6", 0},
+		{"4", 3},
+		{"2", 2},
+	})
+	hash.hotKeys = newHotKeyDetector("test", HotKeyConfig{
+		Threshold: 1,
+		Spread:    3,
+	}, testMetricVecs().hotKeyRequests)
+
+	// 11 maps to 2, but 6 is the least loaded endpoint of the spread set.
+	assert.Equal(t, "6", hash.Get("11").Key())
+}
@@ -0,0 +1,238 @@
+package balance
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Outcome is the outcome of a request, given when releasing its Lease.
+type Outcome int
+
+const (
+	// OutcomeSuccess is a request that succeeded.
+	OutcomeSuccess Outcome = iota
+	// OutcomeError is a request that failed. The error is reported to the
+	// Algorithm if it implements ErrorReporter.
+	OutcomeError
+	// OutcomeCanceled is a request whose context has been canceled.
+	OutcomeCanceled
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSuccess:
+		return "success"
+	case OutcomeError:
+		return "error"
+	case OutcomeCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// LeaserConfig holds the configuration of a Leaser.
+type LeaserConfig struct {
+	// Debug records where each Lease is acquired to track down leaks. Leases
+	// garbage collected without having been released are logged with the stack
+	// trace of their acquisition and Outstanding lists the Leases not released
+	// yet. Debug mode is expensive.
+	// Disabled by default.
+	Debug bool
+}
+
+// Leaser hands out Endpoints of an Algorithm as Leases. Unlike Get and Put,
+// releasing a Lease is idempotent and can be tied to a context.
+type Leaser struct {
+	algo  Algorithm
+	debug bool
+
+	// Debug mode only.
+	mu          sync.Mutex
+	nextID      uint64
+	outstanding map[uint64]*LeaseInfo
+}
+
+// NewLeaser creates a new Leaser object.
+func NewLeaser(algo Algorithm, config LeaserConfig) *Leaser {
+	if algo == nil {
+		return nil
+	}
+	return &Leaser{
+		algo:        algo,
+		debug:       config.Debug,
+		outstanding: make(map[uint64]*LeaseInfo),
+	}
+}
+
+// Lease is an Endpoint acquired for a single request. It must be released with
+// Release once the request has completed.
+type Lease struct {
+	state *leaseState
+}
+
+// leaseState is what's needed to release a Lease. It's kept apart from the
+// Lease so the goroutine waiting on the context of the Lease doesn't keep the
+// Lease reachable: a leaked Lease can still be garbage collected and reported
+// in debug mode.
+type leaseState struct {
+	endpoint Endpoint
+	leaser   *Leaser
+	released int32 // atomic
+	done     chan struct{}
+	id       uint64 // Debug mode only
+}
+
+// LeaseInfo describes an outstanding Lease, see Leaser.Outstanding.
+type LeaseInfo struct {
+	Endpoint Endpoint
+	// Acquired is when the Lease was acquired.
+	Acquired time.Time
+	// Stack is the stack trace of the goroutine that acquired the Lease.
+	Stack string
+}
+
+// Acquire returns a Lease on the Endpoint to use for the next request. The key
+// argument has the same meaning as in Algorithm.Get.
+//
+// The Lease is released with OutcomeCanceled when ctx is done, if it hasn't
+// been released before. Acquire returns nil when the Algorithm returns no
+// Endpoint.
+func (l *Leaser) Acquire(ctx context.Context, key ...string) *Lease {
+	return l.AcquireExcluding(ctx, nil, key...)
+}
+
+// AcquireExcluding is like Acquire but never returns a Lease on one of the
+// excluded Endpoints. See Algorithm.GetExcluding.
+func (l *Leaser) AcquireExcluding(ctx context.Context, excluded []Endpoint, key ...string) *Lease {
+	endpoint := l.algo.GetExcluding(excluded, key...)
+	if endpoint == nil {
+		return nil
+	}
+
+	state := &leaseState{
+		endpoint: endpoint,
+		leaser:   l,
+		done:     make(chan struct{}),
+	}
+	lease := &Lease{state: state}
+
+	if l.debug {
+		l.track(lease)
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				state.release(OutcomeCanceled)
+			case <-state.done:
+			}
+		}()
+	}
+
+	return lease
+}
+
+// track records lease as outstanding. A finalizer reports lease as leaked if
+// it's garbage collected before being released.
+func (l *Leaser) track(lease *Lease) {
+	buf := make([]byte, 8192)
+	buf = buf[:runtime.Stack(buf, false)]
+
+	state := lease.state
+	l.mu.Lock()
+	l.nextID++
+	state.id = l.nextID
+	l.outstanding[state.id] = &LeaseInfo{
+		Endpoint: state.endpoint,
+		Acquired: time.Now(),
+		Stack:    string(buf),
+	}
+	l.mu.Unlock()
+
+	runtime.SetFinalizer(lease, func(lease *Lease) {
+		state := lease.state
+		info := l.info(state.id)
+		// Give the Endpoint back to the Algorithm anyway, unless the Lease
+		// has been released in the meantime.
+		if info == nil || !state.release(OutcomeCanceled) {
+			return
+		}
+		log.Errorf("lease: leaked lease on %s acquired at %s:\n%s",
+			info.Endpoint.Key(), info.Acquired.Format(time.RFC3339), info.Stack)
+	})
+}
+
+// info returns the LeaseInfo of the outstanding Lease id, nil if it has been
+// released.
+func (l *Leaser) info(id uint64) *LeaseInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.outstanding[id]
+}
+
+func (l *Leaser) untrack(id uint64) {
+	l.mu.Lock()
+	delete(l.outstanding, id)
+	l.mu.Unlock()
+}
+
+// Outstanding returns the Leases that haven't been released yet, oldest first.
+// It's only available in debug mode and returns nil otherwise.
+func (l *Leaser) Outstanding() []LeaseInfo {
+	if !l.debug {
+		return nil
+	}
+
+	l.mu.Lock()
+	leases := make([]LeaseInfo, 0, len(l.outstanding))
+	for _, info := range l.outstanding {
+		leases = append(leases, *info)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].Acquired.Before(leases[j].Acquired)
+	})
+	return leases
+}
+
+// Endpoint returns the leased Endpoint.
+func (lease *Lease) Endpoint() Endpoint {
+	return lease.state.endpoint
+}
+
+// Release gives the Endpoint back to the Algorithm. Only the first call has an
+// effect, subsequent calls are ignored.
+func (lease *Lease) Release(outcome Outcome) {
+	lease.state.release(outcome)
+}
+
+// release implements Release. It returns false if the Lease had already been
+// released.
+func (s *leaseState) release(outcome Outcome) bool {
+	if !atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		return false
+	}
+
+	l := s.leaser
+	if l.debug {
+		l.untrack(s.id)
+	}
+
+	if outcome == OutcomeError {
+		if reporter, ok := l.algo.(ErrorReporter); ok {
+			reporter.ReportError(s.endpoint)
+		}
+	}
+	l.algo.Put(s.endpoint)
+	close(s.done)
+	return true
+}
@@ -0,0 +1,104 @@
+package balance
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingAlgo counts Get, Put and ReportError calls.
+type countingAlgo struct {
+	*Consistent
+	gets, puts, errors int
+}
+
+func newCountingAlgo() *countingAlgo {
+	a := &countingAlgo{Consistent: NewConsistent(ConsistentConfig{})}
+	a.AddEndpoints(e("1"))
+	return a
+}
+
+func (a *countingAlgo) GetExcluding(excluded []Endpoint, key ...string) Endpoint {
+	a.gets++
+	return a.Consistent.GetExcluding(excluded, key...)
+}
+
+func (a *countingAlgo) Put(endpoint Endpoint) {
+	a.puts++
+}
+
+func (a *countingAlgo) ReportError(endpoint Endpoint) {
+	a.errors++
+}
+
+func TestLeaseRelease(t *testing.T) {
+	algo := newCountingAlgo()
+	l := NewLeaser(algo, LeaserConfig{})
+
+	lease := l.Acquire(context.Background(), "foo")
+	assert.Equal(t, "1", lease.Endpoint().Key())
+	assert.Equal(t, 1, algo.gets)
+
+	// Release is idempotent.
+	lease.Release(OutcomeError)
+	lease.Release(OutcomeSuccess)
+	assert.Equal(t, 1, algo.puts)
+	assert.Equal(t, 1, algo.errors)
+}
+
+func TestLeaseContext(t *testing.T) {
+	algo := newCountingAlgo()
+	l := NewLeaser(algo, LeaserConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lease := l.Acquire(ctx, "foo")
+	cancel()
+
+	select {
+	case <-lease.state.done:
+	case <-time.After(time.Second):
+		t.Fatal("lease not released on context cancellation")
+	}
+	assert.Equal(t, 1, algo.puts)
+
+	lease.Release(OutcomeSuccess)
+	assert.Equal(t, 1, algo.puts)
+}
+
+func TestLeaseDebug(t *testing.T) {
+	l := NewLeaser(newCountingAlgo(), LeaserConfig{Debug: true})
+
+	first := l.Acquire(context.Background(), "foo")
+	second := l.Acquire(context.Background(), "bar")
+
+	outstanding := l.Outstanding()
+	assert.Len(t, outstanding, 2)
+	assert.Contains(t, outstanding[0].Stack, "TestLeaseDebug")
+
+	first.Release(OutcomeSuccess)
+	second.Release(OutcomeSuccess)
+	assert.Empty(t, l.Outstanding())
+}
+
+func TestLeaseFinalizer(t *testing.T) {
+	algo := NewConsistent(ConsistentConfig{LoadFactor: 1.25})
+	algo.AddEndpoints(e("1"))
+	l := NewLeaser(algo, LeaserConfig{Debug: true})
+
+	// The context outlives the leaked Lease.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l.Acquire(ctx, "foo")
+	assert.Len(t, l.Outstanding(), 1)
+	assert.EqualValues(t, 1, atomic.LoadInt64(&algo.totalLoad))
+
+	assert.True(t, waitFor(func() bool {
+		runtime.GC()
+		return len(l.Outstanding()) == 0
+	}))
+	assert.EqualValues(t, 0, atomic.LoadInt64(&algo.totalLoad))
+}
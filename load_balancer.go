@@ -1,6 +1,10 @@
 package balance
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -9,6 +13,44 @@ type LoadBalancerOptions struct {
 	// Fallback defines the strategy to adopt when the load balancer had no
 	// endpoint. If not specified, defaults to FallbackService.
 	Fallback Fallback
+
+	// PodLabels attaches the labels of the pod behind each Endpoint, making
+	// them available to algorithms such as SubsetRouter.
+	PodLabels bool
+
+	// PodAnnotations attaches the annotations of the pod behind each Endpoint
+	// to their metadata, see Described.
+	PodAnnotations bool
+
+	// Zones looks up the zone of the node hosting each Endpoint, see
+	// Described.
+	Zones bool
+
+	// KeyBy selects what identifies Endpoints. When not keyed by address, use
+	// Address to retrieve the address of an Endpoint.
+	// Defaults to KeyByAddress.
+	KeyBy KeyBy
+
+	// NotReadyAddresses tracks the Endpoints that aren't ready. They keep
+	// their place in the load balancer while not ready, see Readiness.
+	NotReadyAddresses bool
+
+	// Weights selects where Endpoint weights are read from, see
+	// WeightSource. Weights are only used by weight-aware algorithms.
+	// Defaults to WeightNone.
+	Weights WeightSource
+
+	// Ports lists additional ports, names or numbers, the Service Endpoints
+	// are served on. Requests to those ports share the Endpoints and their
+	// loads with requests to the Service port, see Port.
+	Ports []string
+
+	// OnError, if set, is called with the errors encountered watching the
+	// Service. See EndpointWatcher.OnError and Status.
+	OnError func(err error)
+
+	// LeaseDebug enables the debug mode of Leases, see LeaserConfig.Debug.
+	LeaseDebug bool
 }
 
 // LoadBalancer is a Kubernetes Service load balancer.
@@ -17,9 +59,22 @@ type LoadBalancer struct {
 	service    string
 	algo       Algorithm // innermost Algorithm as configured by the user
 	balancer   Algorithm // outermost Algorithm
+	leaser     *Leaser
 	opts       LoadBalancerOptions
+
+	watcher *EndpointWatcher
+	ctx     context.Context // done once the load balancer is stopped
+	cancel  context.CancelFunc
 }
 
+// ErrStopped is returned when waiting on a load balancer that has been
+// stopped.
+var ErrStopped = errors.New("load balancer: stopped")
+
+const (
+	syncPollPeriod = 100 * time.Millisecond
+)
+
 // Fallback is a fallback strategy.
 type Fallback string
 
@@ -44,15 +99,19 @@ func NewLoadBalancer(service string, algo Algorithm, options LoadBalancerOptions
 // Start initializes the load balancer. Start must be called before any other
 // function.
 //
-// The load balancer object may create goroutines or other precious resources.
-// Stopping a load balancer is done by closing the stop channel.
-func (lb *LoadBalancer) Start(stop <-chan interface{}) error {
-	service, err := NewServiceFromString(lb.service)
+// The load balancer watches the Service Endpoints in the background until ctx
+// is done or Stop is called. Start doesn't wait for the Endpoints to be known,
+// see WaitForSync.
+func (lb *LoadBalancer) Start(ctx context.Context) error {
+	client, err := makeInClusterClient()
 	if err != nil {
 		return err
 	}
+	return lb.start(ctx, client)
+}
 
-	client, err := makeInClusterClient()
+func (lb *LoadBalancer) start(ctx context.Context, client kubernetes.Interface) error {
+	service, err := NewServiceFromString(lb.service)
 	if err != nil {
 		return err
 	}
@@ -61,13 +120,23 @@ func (lb *LoadBalancer) Start(stop <-chan interface{}) error {
 		lb.opts.Fallback = FallbackService
 	}
 
-	watcher := EndpointWatcher{
-		Client:   client,
-		Service:  *service,
-		Receiver: lb.algo,
+	lb.kubeClient = client
+	lb.watcher = &EndpointWatcher{
+		Client:            client,
+		Service:           *service,
+		Receiver:          lb.algo,
+		PodLabels:         lb.opts.PodLabels,
+		PodAnnotations:    lb.opts.PodAnnotations,
+		Zones:             lb.opts.Zones,
+		KeyBy:             lb.opts.KeyBy,
+		NotReadyAddresses: lb.opts.NotReadyAddresses,
+		Weights:           lb.opts.Weights,
+		Ports:             lb.opts.Ports,
+		OnError:           lb.opts.OnError,
 	}
 
-	watcher.Start(make(<-chan interface{}))
+	lb.ctx, lb.cancel = context.WithCancel(ctx)
+	lb.watcher.Start(lb.ctx)
 
 	lb.balancer = lb.algo
 
@@ -76,9 +145,50 @@ func (lb *LoadBalancer) Start(stop <-chan interface{}) error {
 		lb.balancer = WithServiceFallback(lb.balancer, service)
 	}
 
+	lb.leaser = NewLeaser(lb.balancer, LeaserConfig{Debug: lb.opts.LeaseDebug})
+
+	return nil
+}
+
+// Stop stops watching the Service and waits for the background goroutines to
+// terminate. Endpoints known at that point are still used.
+func (lb *LoadBalancer) Stop() {
+	if lb.cancel == nil {
+		return
+	}
+	lb.cancel()
+	lb.watcher.Wait()
+}
+
+// WaitForSync blocks until the load balancer has received the first list of
+// Service Endpoints. It returns the ctx error when ctx is done first, and
+// ErrStopped if the load balancer is stopped first.
+func (lb *LoadBalancer) WaitForSync(ctx context.Context) error {
+	ticker := time.NewTicker(syncPollPeriod)
+	defer ticker.Stop()
+
+	for !lb.watcher.HasSynced() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-lb.ctx.Done():
+			return ErrStopped
+		case <-ticker.C:
+		}
+	}
 	return nil
 }
 
+// Status returns the state of the connection to the Kubernetes API server. A
+// load balancer that isn't healthy keeps using the last Endpoints it knows
+// about.
+func (lb *LoadBalancer) Status() WatcherStatus {
+	if lb.watcher == nil {
+		return WatcherStatus{}
+	}
+	return lb.watcher.Status()
+}
+
 // Get returns the Service Endpoint to use for the next request.
 //
 // Get is called when wanting to send a request to a Service. It returns the
@@ -96,7 +206,66 @@ func (lb *LoadBalancer) Get(key ...string) Endpoint {
 	return lb.balancer.Get(key...)
 }
 
+// GetExcluding is like Get but never returns one of the excluded Endpoints.
+// It's useful to retry a failed request on a different Endpoint. When all
+// Endpoints are excluded, GetExcluding applies the configured Fallback
+// strategy.
+func (lb *LoadBalancer) GetExcluding(excluded []Endpoint, key ...string) Endpoint {
+	return lb.balancer.GetExcluding(excluded, key...)
+}
+
 // Put releases the Endpoint when it has finished processing the request.
 func (lb *LoadBalancer) Put(endpoint Endpoint) {
 	lb.balancer.Put(endpoint)
 }
+
+// Port returns a view of the load balancer for port, one of the Ports given in
+// the options, the Service port or any port number. Endpoints returned by the
+// PortBalancer have the address of the port, see Address, and must be released
+// with its Put.
+func (lb *LoadBalancer) Port(port string) *PortBalancer {
+	return NewPortBalancer(lb.balancer, port)
+}
+
+// Acquire returns a Lease on the Endpoint to use for the next request. See
+// Leaser.Acquire.
+func (lb *LoadBalancer) Acquire(ctx context.Context, key ...string) *Lease {
+	return lb.leaser.Acquire(ctx, key...)
+}
+
+// AcquireExcluding is like Acquire but never returns a Lease on one of the
+// excluded Endpoints. See Leaser.AcquireExcluding.
+func (lb *LoadBalancer) AcquireExcluding(ctx context.Context, excluded []Endpoint, key ...string) *Lease {
+	return lb.leaser.AcquireExcluding(ctx, excluded, key...)
+}
+
+// OutstandingLeases returns the Leases that haven't been released yet when
+// LeaseDebug is set. See Leaser.Outstanding.
+func (lb *LoadBalancer) OutstandingLeases() []LeaseInfo {
+	return lb.leaser.Outstanding()
+}
+
+// GetFromSubset returns the Endpoint to use for the next request, choosing
+// among the Endpoints of subset. The Algorithm given to NewLoadBalancer must be
+// a *SubsetRouter. See SubsetRouter.GetFromSubset for details.
+func (lb *LoadBalancer) GetFromSubset(subset string, key ...string) Endpoint {
+	router, ok := lb.algo.(*SubsetRouter)
+	if !ok {
+		panic("load balancer: GetFromSubset needs a SubsetRouter algorithm")
+	}
+	if endpoint := router.GetFromSubset(subset, key...); endpoint != nil {
+		return endpoint
+	}
+	// No endpoint in the subset nor in the default subset, let the outermost
+	// Algorithm apply its fallback strategy.
+	return lb.balancer.Get(key...)
+}
+
+// ReportError records that a request sent to endpoint failed, if the Algorithm
+// implements ErrorReporter. It must be called before releasing the Endpoint
+// with Put.
+func (lb *LoadBalancer) ReportError(endpoint Endpoint) {
+	if reporter, ok := lb.balancer.(ErrorReporter); ok {
+		reporter.ReportError(endpoint)
+	}
+}
@@ -0,0 +1,58 @@
+package balance
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func TestLoadBalancerLifecycle(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []corev1.EndpointPort{{Port: 8080}},
+		}},
+	})
+	lb := NewLoadBalancer("db.default:8080", NewConsistent(ConsistentConfig{}), LoadBalancerOptions{
+		Fallback: FallbackNone,
+	})
+	assert.NoError(t, lb.start(context.Background(), client))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, lb.WaitForSync(ctx))
+	assert.Equal(t, "10.0.0.1:8080", lb.Get("foo").Key())
+
+	// Known Endpoints are still used once stopped.
+	lb.Stop()
+	assert.Equal(t, "10.0.0.1:8080", lb.Get("foo").Key())
+}
+
+func TestLoadBalancerWaitForSync(t *testing.T) {
+	// The API server never answers.
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "endpoints", func(ktesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("unavailable")
+	})
+	lb := NewLoadBalancer("db.default:8080", NewConsistent(ConsistentConfig{}), LoadBalancerOptions{})
+	assert.NoError(t, lb.start(context.Background(), client))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, lb.WaitForSync(ctx))
+	status := lb.Status()
+	assert.False(t, status.Healthy())
+	assert.EqualError(t, status.LastError, "unavailable")
+
+	go lb.Stop()
+	assert.Equal(t, ErrStopped, lb.WaitForSync(context.Background()))
+}
@@ -0,0 +1,111 @@
+package balance
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLoadHalfLife = time.Second
+)
+
+// LoadModel is how Consistent measures the load of Endpoints with bounded
+// loads.
+type LoadModel int
+
+const (
+	// LoadInFlight measures the load of an Endpoint as the number of requests
+	// in-flight. It works well for long requests but, with short requests, loads
+	// are mostly 0 or 1 and only concurrent bursts are spread.
+	LoadInFlight LoadModel = iota
+
+	// LoadRate measures the load of an Endpoint as its request rate, decayed
+	// exponentially over time. Sustained traffic is spread as well as
+	// concurrent traffic, whatever the duration of requests. Rates are
+	// updated without locks but each Get updates the shared total rate with a
+	// compare-and-swap, which is more expensive than LoadInFlight under
+	// contention.
+	LoadRate
+)
+
+// rebaseHalfLives is the number of half-lives after which the state of a
+// decayedRate is rebased, keeping scaled values far from overflowing.
+const rebaseHalfLives = 32
+
+// decayedRate is a request counter decaying exponentially over time. With a
+// constant request rate, its value converges to rate * halfLife / ln(2).
+//
+// Counting and reading don't take any lock: the value is stored scaled to a
+// base time, so that a request counts for 2^((t - base) / halfLife), and is
+// updated with a compare-and-swap. The base is moved forward, under a lock,
+// every rebaseHalfLives half-lives. Requests counted concurrently with a
+// rebase may be lost.
+type decayedRate struct {
+	mu    sync.Mutex   // Serializes rebases
+	state atomic.Value // *rateState
+}
+
+// rateState is the value of a decayedRate, scaled to base.
+type rateState struct {
+	bits uint64 // atomic, float64 scaled value. First for 64-bit alignment.
+	base time.Time
+}
+
+// scale returns the factor between values at base and at now.
+func (s *rateState) scale(now time.Time, halfLife time.Duration) float64 {
+	elapsed := now.Sub(s.base)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Exp2(float64(elapsed) / float64(halfLife))
+}
+
+// value returns the counter value at time now.
+func (s *rateState) value(now time.Time, halfLife time.Duration) float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.bits)) / s.scale(now, halfLife)
+}
+
+// load returns the current state, rebasing it to now if its base is too old.
+func (r *decayedRate) load(now time.Time, halfLife time.Duration) *rateState {
+	fresh := func(s *rateState) bool {
+		return s != nil && now.Sub(s.base) < rebaseHalfLives*halfLife
+	}
+
+	s, _ := r.state.Load().(*rateState)
+	if fresh(s) {
+		return s
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, _ = r.state.Load().(*rateState)
+	if fresh(s) {
+		return s
+	}
+	rebased := &rateState{base: now}
+	if s != nil {
+		rebased.bits = math.Float64bits(s.value(now, halfLife))
+	}
+	r.state.Store(rebased)
+	return rebased
+}
+
+// get returns the counter value at time now.
+func (r *decayedRate) get(now time.Time, halfLife time.Duration) float64 {
+	return r.load(now, halfLife).value(now, halfLife)
+}
+
+// add counts n requests at time now.
+func (r *decayedRate) add(now time.Time, halfLife time.Duration, n float64) {
+	s := r.load(now, halfLife)
+	delta := n * s.scale(now, halfLife)
+	for {
+		old := atomic.LoadUint64(&s.bits)
+		value := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&s.bits, old, value) {
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package balance
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecayedRate(t *testing.T) {
+	start := time.Unix(0, 0)
+	r := &decayedRate{}
+
+	r.add(start, time.Second, 4)
+	assert.Equal(t, 4.0, r.get(start, time.Second))
+	assert.InDelta(t, 2, r.get(start.Add(time.Second), time.Second), 1e-9)
+	assert.InDelta(t, 1, r.get(start.Add(2*time.Second), time.Second), 1e-9)
+
+	// Reads don't decay the counter, only time does.
+	assert.InDelta(t, 4, r.get(start, time.Second), 1e-9)
+	assert.InDelta(t, 1, r.get(start.Add(2*time.Second), time.Second), 1e-9)
+
+	// The value is kept across rebases.
+	later := start.Add(100 * time.Second)
+	r.add(later, time.Second, 1)
+	assert.InDelta(t, 1, r.get(later, time.Second), 1e-9)
+	assert.InDelta(t, 0.5, r.get(later.Add(time.Second), time.Second), 1e-9)
+}
+
+func TestDecayedRateConcurrent(t *testing.T) {
+	start := time.Unix(0, 0)
+	r := &decayedRate{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				r.add(start, time.Second, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 8000.0, r.get(start, time.Second))
+}
+
+func TestLoadRate(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 3,
+		Hash:             testHash,
+		LoadFactor:       1.25,
+		LoadModel:        LoadRate,
+	})
+	hash.now = clock.now
+	hash.AddEndpoints(e("2"), e("4"), e("6"))
+
+	// Short requests are spread, even though loads never go above 1.
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		endpoint := hash.Get("11")
+		counts[endpoint.Key()]++
+		hash.Put(endpoint)
+		clock.t = clock.t.Add(10 * time.Millisecond)
+	}
+	// With LoadInFlight, they would all go to 2.
+	assert.Len(t, counts, 3)
+	for _, count := range counts {
+		assert.True(t, count <= 13, "%v", counts)
+	}
+	assert.Equal(t, int64(0), hash.totalLoad)
+
+	// Once the rate has decayed, requests go back to 2.
+	clock.t = clock.t.Add(time.Minute)
+	assert.Equal(t, "2", hash.Get("11").Key())
+}
@@ -0,0 +1,183 @@
+package balance
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultMaxEndpointSeries = 100
+
+	// otherEndpoint is the endpoint label value shared by the Endpoints past
+	// MetricsConfig.MaxEndpointSeries.
+	otherEndpoint = "other"
+)
+
+// use program name as prefix for metrics
+var defaultNamespace = strings.ReplaceAll(filepath.Base(os.Args[0]), ".", "_")
+
+// MetricsConfig configures the Prometheus metrics of an Algorithm.
+type MetricsConfig struct {
+	// Registerer is where metrics are registered. Algorithms sharing a
+	// Registerer and a Namespace share the same metrics, told apart by their
+	// name label.
+	// Defaults to prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+
+	// Namespace is the prefix of the metric names.
+	// Defaults to the program name.
+	Namespace string
+
+	// EndpointMetrics enables per-endpoint series: in-flight requests, requests,
+	// requests received because another Endpoint overflowed, errors and the
+	// fraction of the hash ring owned. The ring ownership peak-to-mean ratio,
+	// a single series, is always computed.
+	// Disabled by default.
+	EndpointMetrics bool
+
+	// MaxEndpointSeries is the maximum number of Endpoints with their own
+	// per-endpoint series. Endpoints past the limit share the series labeled
+	// endpoint="other". Series of removed Endpoints are deleted once they have
+	// drained.
+	// Defaults to 100.
+	MaxEndpointSeries int
+}
+
+// metricVecs holds the metrics registered by an Algorithm.
+type metricVecs struct {
+	inflight       *prometheus.GaugeVec
+	endpoints      *prometheus.GaugeVec
+	requests       *prometheus.CounterVec
+	overflowed     *prometheus.CounterVec
+	hot            *prometheus.CounterVec
+	hotKeyRequests *prometheus.GaugeVec
+	draining       *prometheus.GaugeVec
+	drainTimeouts  *prometheus.CounterVec
+
+	endpointInflight         *prometheus.GaugeVec
+	endpointRequests         *prometheus.CounterVec
+	endpointOverflowReceived *prometheus.CounterVec
+	endpointErrors           *prometheus.CounterVec
+	endpointOwnership        *prometheus.GaugeVec
+	ownershipPeakToMean      *prometheus.GaugeVec
+	remapped                 *prometheus.HistogramVec
+}
+
+func newMetricVecs(config MetricsConfig) *metricVecs {
+	reg := config.Registerer
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	ns := config.Namespace
+	if ns == "" {
+		ns = defaultNamespace
+	}
+
+	gauge := func(name, help string, labels ...string) *prometheus.GaugeVec {
+		vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      name,
+			Help:      help,
+		}, labels)
+		return register(reg, vec).(*prometheus.GaugeVec)
+	}
+	counter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		vec := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      name,
+			Help:      help,
+		}, labels)
+		return register(reg, vec).(*prometheus.CounterVec)
+	}
+
+	histogram := func(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+		vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Name:      name,
+			Help:      help,
+			Buckets:   buckets,
+		}, labels)
+		return register(reg, vec).(*prometheus.HistogramVec)
+	}
+
+	return &metricVecs{
+		inflight: gauge("lb_requests_inflight",
+			"Total number of requests in-flight.", "name"),
+		endpoints: gauge("lb_endpoints",
+			"Number of endpoints for this service.", "name"),
+		requests: counter("lb_requests_total",
+			"Number of processed requests.", "name"),
+		overflowed: counter("lb_requests_overflowed_total",
+			"Number of requests that overflowed the load factor.", "name"),
+		hot: counter("lb_requests_hot_total",
+			"Number of requests for hot keys that have been spread across endpoints.", "name"),
+		hotKeyRequests: gauge("lb_hot_key_requests",
+			"Estimated number of requests for a hot key over the detection window.", "name", "key"),
+		draining: gauge("lb_endpoints_draining",
+			"Number of removed endpoints waiting for their in-flight requests to finish.", "name"),
+		drainTimeouts: counter("lb_endpoints_drain_timeouts_total",
+			"Number of endpoints that still had requests in-flight when their drain timeout expired.", "name"),
+
+		endpointInflight: gauge("lb_endpoint_requests_inflight",
+			"Number of requests in-flight per endpoint.", "name", "endpoint"),
+		endpointRequests: counter("lb_endpoint_requests_total",
+			"Number of requests per endpoint.", "name", "endpoint"),
+		endpointOverflowReceived: counter("lb_endpoint_requests_overflow_received_total",
+			"Number of requests received by an endpoint because another endpoint overflowed the load factor.", "name", "endpoint"),
+		endpointErrors: counter("lb_endpoint_errors_total",
+			"Number of failed requests per endpoint.", "name", "endpoint"),
+		endpointOwnership: gauge("lb_endpoint_ring_ownership",
+			"Fraction of the hash ring owned by an endpoint.", "name", "endpoint"),
+		ownershipPeakToMean: gauge("lb_ring_ownership_peak_to_mean",
+			"Ratio between the largest fraction of the hash ring owned by an endpoint and the mean.", "name"),
+		remapped: histogram("lb_ring_remapped_fraction",
+			"Fraction of the key space mapped to a different endpoint after an endpoint change.",
+			[]float64{.001, .01, .05, .1, .2, .3, .5, .75, 1}, "name"),
+	}
+}
+
+// register registers c with reg. If an identical collector is already
+// registered, the existing one is returned instead.
+func register(reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
+// endpointMetrics holds the per-endpoint series of an Endpoint, bound once to
+// keep label lookups out of Get and Put.
+type endpointMetrics struct {
+	label            string
+	shared           bool // Whether label is otherEndpoint.
+	inflight         prometheus.Gauge
+	requests         prometheus.Counter
+	overflowReceived prometheus.Counter
+	errors           prometheus.Counter
+	ownership        prometheus.Gauge
+}
+
+func (m *metricVecs) endpointMetrics(name, endpoint string) *endpointMetrics {
+	return &endpointMetrics{
+		label:            endpoint,
+		inflight:         m.endpointInflight.WithLabelValues(name, endpoint),
+		requests:         m.endpointRequests.WithLabelValues(name, endpoint),
+		overflowReceived: m.endpointOverflowReceived.WithLabelValues(name, endpoint),
+		errors:           m.endpointErrors.WithLabelValues(name, endpoint),
+		ownership:        m.endpointOwnership.WithLabelValues(name, endpoint),
+	}
+}
+
+func (m *metricVecs) deleteEndpointMetrics(name, endpoint string) {
+	m.endpointInflight.DeleteLabelValues(name, endpoint)
+	m.endpointRequests.DeleteLabelValues(name, endpoint)
+	m.endpointOverflowReceived.DeleteLabelValues(name, endpoint)
+	m.endpointErrors.DeleteLabelValues(name, endpoint)
+	m.endpointOwnership.DeleteLabelValues(name, endpoint)
+}
@@ -0,0 +1,139 @@
+package balance
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMetricVecs() *metricVecs {
+	return newMetricVecs(MetricsConfig{Registerer: prometheus.NewRegistry()})
+}
+
+// metricValues returns the values of the name series, indexed by the value of
+// the label label.
+func metricValues(t *testing.T, reg *prometheus.Registry, name, label string) map[string]float64 {
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			var labelValue string
+			for _, pair := range m.GetLabel() {
+				if pair.GetName() == label {
+					labelValue = pair.GetValue()
+				}
+			}
+			switch {
+			case m.GetGauge() != nil:
+				values[labelValue] = m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				values[labelValue] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestMetricsRegisterer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	config := MetricsConfig{Registerer: reg, Namespace: "test"}
+
+	a := NewConsistent(ConsistentConfig{Name: "a", Metrics: config})
+	b := NewConsistent(ConsistentConfig{Name: "b", Metrics: config})
+	a.AddEndpoints(e("1"), e("2"))
+	b.AddEndpoints(e("1"))
+
+	// Both Consistent objects share the same metrics.
+	assert.Equal(t, map[string]float64{"a": 2, "b": 1},
+		metricValues(t, reg, "test_lb_endpoints", "name"))
+}
+
+func TestEndpointMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	hash := NewConsistent(ConsistentConfig{
+		ReplicationCount: 3,
+		Hash:             testHash,
+		LoadFactor:       1.25,
+		Metrics: MetricsConfig{
+			Registerer:        reg,
+			Namespace:         "test",
+			EndpointMetrics:   true,
+			MaxEndpointSeries: 2,
+		},
+	})
+	hash.AddEndpoints(e("2"), e("4"), e("6"))
+
+	endpoint := hash.Get("11")
+	assert.Equal(t, "2", endpoint.Key())
+	hash.ReportError(endpoint)
+
+	// Only the first 2 endpoints have their own series.
+	assert.Equal(t, map[string]float64{"2": 1, "4": 0, "other": 0},
+		metricValues(t, reg, "test_lb_endpoint_requests_inflight", "endpoint"))
+	assert.Equal(t, map[string]float64{"2": 1, "4": 0, "other": 0},
+		metricValues(t, reg, "test_lb_endpoint_errors_total", "endpoint"))
+
+	// 2 is overloaded, the request goes to 4.
+	assert.Equal(t, "4", hash.Get("11").Key())
+	assert.Equal(t, map[string]float64{"2": 0, "4": 1, "other": 0},
+		metricValues(t, reg, "test_lb_endpoint_requests_overflow_received_total", "endpoint"))
+
+	// Series are deleted once a removed endpoint has drained.
+	hash.RemoveEndpoints(endpoint)
+	assert.Contains(t, metricValues(t, reg, "test_lb_endpoint_requests_total", "endpoint"), "2")
+	hash.Put(endpoint)
+	assert.NotContains(t, metricValues(t, reg, "test_lb_endpoint_requests_total", "endpoint"), "2")
+
+	// The freed slot can be used by a new endpoint.
+	hash.AddEndpoints(e("8"))
+	assert.Contains(t, metricValues(t, reg, "test_lb_endpoint_requests_total", "endpoint"), "8")
+}
+
+func TestOwnershipMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	hash := NewConsistent(ConsistentConfig{
+		Name:     "test",
+		HashName: "xxhash",
+		Metrics: MetricsConfig{
+			Registerer:        reg,
+			Namespace:         "test",
+			EndpointMetrics:   true,
+			MaxEndpointSeries: 2,
+		},
+	})
+	hash.AddEndpoints(e("a"), e("b"), e("c"))
+
+	owned := metricValues(t, reg, "test_lb_endpoint_ring_ownership", "endpoint")
+	assert.Len(t, owned, 3)
+	assert.InDelta(t, 1, owned["a"]+owned["b"]+owned["other"], 1e-9)
+
+	peakToMean := metricValues(t, reg, "test_lb_ring_ownership_peak_to_mean", "name")["test"]
+	assert.True(t, peakToMean >= 1 && peakToMean < 1.5)
+
+	// Removed endpoints don't own anything. The shared series goes away when
+	// unused.
+	hash.RemoveEndpoints(e("c"))
+	owned = metricValues(t, reg, "test_lb_endpoint_ring_ownership", "endpoint")
+	assert.NotContains(t, owned, "other")
+	assert.InDelta(t, 1, owned["a"]+owned["b"], 1e-9)
+}
+
+func TestPeakToMeanWithoutEndpointMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	hash := NewConsistent(ConsistentConfig{
+		Name:     "test",
+		HashName: "xxhash",
+		Metrics:  MetricsConfig{Registerer: reg, Namespace: "test"},
+	})
+	hash.AddEndpoints(e("a"), e("b"), e("c"))
+
+	peakToMean := metricValues(t, reg, "test_lb_ring_ownership_peak_to_mean", "name")["test"]
+	assert.True(t, peakToMean >= 1 && peakToMean < 1.5)
+	assert.Empty(t, metricValues(t, reg, "test_lb_endpoint_ring_ownership", "endpoint"))
+}
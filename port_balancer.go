@@ -0,0 +1,88 @@
+package balance
+
+// PortBalancer balances requests to one of the ports of multi-port Endpoints.
+// It shares the Endpoints and their loads with the LoadBalancer it comes from:
+// Endpoints are the same whatever the port, only their address differs. See
+// LoadBalancer.Port.
+type PortBalancer struct {
+	algo Algorithm
+	port string
+}
+
+// portEndpoint is an Endpoint seen through one of its ports. It has the same
+// key as the Endpoint but the address of the port.
+type portEndpoint struct {
+	Endpoint
+	address string
+}
+
+// Address returns the address of the Endpoint for the port.
+func (e *portEndpoint) Address() string {
+	return e.address
+}
+
+func (e *portEndpoint) String() string {
+	return e.address
+}
+
+var _ Addressed = &portEndpoint{}
+
+// unwrapPort returns the Endpoint behind endpoint.
+func unwrapPort(endpoint Endpoint) Endpoint {
+	if e, ok := endpoint.(*portEndpoint); ok {
+		return e.Endpoint
+	}
+	return endpoint
+}
+
+// NewPortBalancer creates a PortBalancer object getting Endpoints from algo
+// and returning their address for port, a port name or number.
+func NewPortBalancer(algo Algorithm, port string) *PortBalancer {
+	if algo == nil || port == "" {
+		return nil
+	}
+	return &PortBalancer{
+		algo: algo,
+		port: port,
+	}
+}
+
+// Get returns the Endpoint to use for the next request. The address of the
+// returned Endpoint, see Address, is the address of the port. Endpoints that
+// aren't served on the port are skipped.
+func (p *PortBalancer) Get(key ...string) Endpoint {
+	return p.GetExcluding(nil, key...)
+}
+
+// GetExcluding is like Get but never returns one of the excluded Endpoints.
+func (p *PortBalancer) GetExcluding(excluded []Endpoint, key ...string) Endpoint {
+	for {
+		endpoint := p.algo.GetExcluding(excluded, key...)
+		if endpoint == nil {
+			return nil
+		}
+		if address, ok := PortAddress(endpoint, p.port); ok {
+			return &portEndpoint{Endpoint: endpoint, address: address}
+		}
+		// Not served on the port, try the next Endpoint.
+		p.algo.Put(endpoint)
+		if isExcluded(endpoint, excluded) {
+			// The Algorithm ignored the exclusion list, eg. a fallback.
+			return nil
+		}
+		excluded = append(excluded[:len(excluded):len(excluded)], endpoint)
+	}
+}
+
+// Put releases the Endpoint when it has finished processing the request.
+func (p *PortBalancer) Put(endpoint Endpoint) {
+	p.algo.Put(unwrapPort(endpoint))
+}
+
+// ReportError records that a request sent to endpoint failed, if the Algorithm
+// implements ErrorReporter.
+func (p *PortBalancer) ReportError(endpoint Endpoint) {
+	if reporter, ok := p.algo.(ErrorReporter); ok {
+		reporter.ReportError(unwrapPort(endpoint))
+	}
+}
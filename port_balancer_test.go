@@ -0,0 +1,49 @@
+package balance
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func multiPortEndpoint(ip string, ports map[string]int32) Endpoint {
+	return newKubernetesEndpoint(ip, EndpointMetadata{
+		Address: ip + ":8080",
+		IP:      ip,
+		Port:    8080,
+		Ports:   ports,
+		Ready:   true,
+	})
+}
+
+func TestPortBalancer(t *testing.T) {
+	hash := NewConsistent(ConsistentConfig{HashName: "xxhash", LoadFactor: 1.25})
+	hash.AddEndpoints(
+		multiPortEndpoint("10.0.0.1", map[string]int32{"http": 8080, "grpc": 9000}),
+		multiPortEndpoint("10.0.0.2", map[string]int32{"http": 8080}),
+	)
+	grpc := NewPortBalancer(hash, "grpc")
+
+	// Only 10.0.0.1 is served on the grpc port, whatever the key.
+	var endpoints []Endpoint
+	for i := 0; i < 10; i++ {
+		endpoint := grpc.Get(strconv.Itoa(i))
+		assert.Equal(t, "10.0.0.1", endpoint.Key())
+		assert.Equal(t, "10.0.0.1:9000", Address(endpoint))
+		endpoints = append(endpoints, endpoint)
+	}
+
+	// Loads are shared with the other ports and skipped Endpoints have been
+	// released.
+	ownership := hash.Ownership()
+	assert.Equal(t, int64(10), ownership[0].Load)
+	assert.Equal(t, int64(0), ownership[1].Load)
+	for _, endpoint := range endpoints {
+		grpc.Put(endpoint)
+	}
+	assert.Equal(t, int64(0), hash.Ownership()[0].Load)
+
+	// No Endpoint is served on the admin port.
+	assert.Nil(t, NewPortBalancer(hash, "admin").Get("1"))
+}
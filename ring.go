@@ -0,0 +1,199 @@
+package balance
+
+import (
+	"math"
+	"sort"
+)
+
+// virtualNode is a point on the hash ring.
+type virtualNode struct {
+	hash uint64
+	info *endpointInfo
+}
+
+// less orders virtual nodes by hash. Virtual nodes of different endpoints may
+// collide: the endpoint keys are then compared so the ring layout doesn't
+// depend on the order endpoints have been added in.
+func (n virtualNode) less(other virtualNode) bool {
+	if n.hash != other.hash {
+		return n.hash < other.hash
+	}
+	return n.info.endpoint.Key() < other.info.endpoint.Key()
+}
+
+// ring is an immutable snapshot of the consistent hashing ring. A new ring is
+// built each time Endpoints are added or removed, which allows lookups without
+// taking any lock.
+type ring struct {
+	nodes        []virtualNode // Sorted with virtualNode.less
+	numEndpoints int
+}
+
+var emptyRing = &ring{}
+
+// isEmpty returns true if there are no items available.
+func (r *ring) isEmpty() bool {
+	return len(r.nodes) == 0
+}
+
+// search returns the index of the first virtual node with a hash >= hash.
+func (r *ring) search(hash uint64) int {
+	// Binary search for appropriate replica.
+	idx := sort.Search(len(r.nodes), func(i int) bool { return r.nodes[i].hash >= hash })
+
+	// Means we have cycled back to the first replica.
+	if idx == len(r.nodes) {
+		idx = 0
+	}
+
+	return idx
+}
+
+// next returns the index of the virtual node following idx, cycling if needed.
+func (r *ring) next(idx int) int {
+	idx++
+	if idx >= len(r.nodes) {
+		idx = 0
+	}
+	return idx
+}
+
+// add returns a new ring with the added virtual nodes. added must be sorted.
+func (r *ring) add(added []virtualNode, numEndpoints int) *ring {
+	a, b := r.nodes, added
+	merged := make([]virtualNode, 0, len(a)+len(b))
+
+	for len(a) > 0 && len(b) > 0 {
+		if !b[0].less(a[0]) {
+			merged = append(merged, a[0])
+			a = a[1:]
+		} else {
+			merged = append(merged, b[0])
+			b = b[1:]
+		}
+	}
+	merged = append(merged, a...)
+	merged = append(merged, b...)
+
+	return &ring{
+		nodes:        merged,
+		numEndpoints: r.numEndpoints + numEndpoints,
+	}
+}
+
+// remove returns a new ring without the virtual nodes of the removed
+// endpoints.
+func (r *ring) remove(removed map[*endpointInfo]bool) *ring {
+	nodes := make([]virtualNode, 0, len(r.nodes))
+
+	for _, node := range r.nodes {
+		if removed[node.info] {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+
+	return &ring{
+		nodes:        nodes,
+		numEndpoints: r.numEndpoints - len(removed),
+	}
+}
+
+// removeNodes returns a new ring without some of the virtual nodes of
+// endpoints. removed holds, per endpoint, the number of virtual nodes to remove
+// for each hash.
+func (r *ring) removeNodes(removed map[*endpointInfo]map[uint64]int) *ring {
+	nodes := make([]virtualNode, 0, len(r.nodes))
+
+	for _, node := range r.nodes {
+		if hashes := removed[node.info]; hashes[node.hash] > 0 {
+			hashes[node.hash]--
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+
+	return &ring{
+		nodes:        nodes,
+		numEndpoints: r.numEndpoints,
+	}
+}
+
+// ownership returns the fraction of the hash space owned by each endpoint of
+// the ring. A virtual node owns the arc between the previous virtual node,
+// excluded, and itself. bits is the width of the hash values.
+func (r *ring) ownership(bits uint) map[*endpointInfo]float64 {
+	owned := make(map[*endpointInfo]float64, r.numEndpoints)
+	if r.isEmpty() {
+		return owned
+	}
+
+	space := math.Exp2(float64(bits))
+	last := r.nodes[len(r.nodes)-1].hash
+	for i, node := range r.nodes {
+		var arc float64
+		if i == 0 {
+			// The first virtual node owns the arc wrapping around the end of
+			// the hash space.
+			arc = space - float64(last) + float64(node.hash)
+		} else {
+			arc = float64(node.hash - r.nodes[i-1].hash)
+		}
+		owned[node.info] += arc / space
+	}
+
+	return owned
+}
+
+// remapped calls f for each arc of the hash space owned by a different
+// endpoint in r and to, with the length of the arc as a fraction of the hash
+// space. bits is the width of the hash values. Both rings must not be empty.
+func (r *ring) remapped(to *ring, bits uint, f func(from, to *endpointInfo, fraction float64)) {
+	a, b := r.nodes, to.nodes
+	space := math.Exp2(float64(bits))
+	last := a[len(a)-1].hash
+	if b[len(b)-1].hash > last {
+		last = b[len(b)-1].hash
+	}
+
+	// Walk the virtual nodes of both rings in order. Each hash is the end of
+	// an arc owned by the first virtual node >= hash in each ring.
+	i, j := 0, 0
+	var prev uint64
+	for i < len(a) || j < len(b) {
+		var hash uint64
+		if j == len(b) || (i < len(a) && a[i].hash <= b[j].hash) {
+			hash = a[i].hash
+		} else {
+			hash = b[j].hash
+		}
+
+		from, owner := a[0].info, b[0].info
+		if i < len(a) {
+			from = a[i].info
+		}
+		if j < len(b) {
+			owner = b[j].info
+		}
+
+		var arc float64
+		if i == 0 && j == 0 {
+			// The first arc wraps around the end of the hash space.
+			arc = space - float64(last) + float64(hash)
+		} else {
+			arc = float64(hash - prev)
+		}
+		// Endpoints added back get a new endpointInfo, compare keys.
+		if arc > 0 && from != owner && from.endpoint.Key() != owner.endpoint.Key() {
+			f(from, owner, arc/space)
+		}
+
+		for i < len(a) && a[i].hash == hash {
+			i++
+		}
+		for j < len(b) && b[j].hash == hash {
+			j++
+		}
+		prev = hash
+	}
+}
@@ -0,0 +1,74 @@
+package balance
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"strconv"
+)
+
+// RingLayout describes how Consistent places Endpoints on the hash ring: how
+// virtual nodes are named, the default hash function and the default number
+// of virtual nodes per Endpoint.
+//
+// Processes load balancing the same Service must use the same layout to agree
+// on where keys go. A layout, once released, never changes.
+type RingLayout int
+
+const (
+	// RingLayoutV1 is the original layout. The ith virtual node of an Endpoint
+	// is named after the decimal representation of i followed by the Endpoint
+	// key. This naming is ambiguous: replica 1 of "23" and replica 12 of "3"
+	// have the same name and, consequently, the same hash.
+	//
+	// RingLayoutV1 defaults to CRC32 and 256 virtual nodes per Endpoint.
+	RingLayoutV1 RingLayout = 1
+
+	// RingLayoutV2 names the ith virtual node of an Endpoint with i encoded as
+	// a 32-bit big-endian integer followed by the Endpoint key. Distinct virtual
+	// nodes always have distinct names.
+	//
+	// RingLayoutV2 defaults to CRC32 and 256 virtual nodes per Endpoint.
+	RingLayoutV2 RingLayout = 2
+
+	// DefaultRingLayout is the layout used when none is specified. It stays
+	// RingLayoutV1 so different versions of this library agree on key
+	// placement.
+	DefaultRingLayout = RingLayoutV1
+)
+
+// valid returns true if l is a known layout.
+func (l RingLayout) valid() bool {
+	return l == RingLayoutV1 || l == RingLayoutV2
+}
+
+// defaultHash returns the hash function used when none is specified.
+func (l RingLayout) defaultHash() Hash64 {
+	return Hash32To64(crc32.ChecksumIEEE)
+}
+
+// defaultHashBits returns the width of the values of the default hash
+// function.
+func (l RingLayout) defaultHashBits() uint {
+	return 32
+}
+
+// defaultReplicationCount returns the number of virtual nodes per Endpoint
+// used when none is specified.
+func (l RingLayout) defaultReplicationCount() int {
+	return 256
+}
+
+// virtualNodeName returns the name of the ith virtual node of the Endpoint
+// with the given key. Virtual nodes are placed on the ring by hashing their
+// name.
+func (l RingLayout) virtualNodeName(key string, i int) []byte {
+	switch l {
+	case RingLayoutV2:
+		name := make([]byte, 4+len(key))
+		binary.BigEndian.PutUint32(name, uint32(i))
+		copy(name[4:], key)
+		return name
+	default:
+		return []byte(strconv.Itoa(i) + key)
+	}
+}
@@ -0,0 +1,98 @@
+package balance
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualNodeName(t *testing.T) {
+	// RingLayoutV1 names are ambiguous.
+	assert.Equal(t, RingLayoutV1.virtualNodeName("23", 1), RingLayoutV1.virtualNodeName("3", 12))
+	assert.NotEqual(t, RingLayoutV2.virtualNodeName("23", 1), RingLayoutV2.virtualNodeName("3", 12))
+
+	assert.Equal(t, []byte("12foo"), RingLayoutV1.virtualNodeName("foo", 12))
+	assert.Equal(t, []byte("\x00\x00\x00\x0cfoo"), RingLayoutV2.virtualNodeName("foo", 12))
+}
+
+func TestInvalidRingLayout(t *testing.T) {
+	assert.Nil(t, NewConsistent(ConsistentConfig{Layout: 42}))
+}
+
+// Golden key placements for a fixed set of endpoints. Those must never change:
+// processes using different versions of the library need to agree on where
+// keys go. Add a new layout instead.
+var ringLayoutVectors = []struct {
+	layout    RingLayout
+	placement []struct{ key, endpoint string }
+}{
+	{
+		RingLayoutV1,
+		[]struct{ key, endpoint string }{
+			{"user-0", "10.0.0.3:8080"},
+			{"user-1", "10.0.0.1:8080"},
+			{"user-2", "10.0.0.5:8080"},
+			{"user-3", "10.0.0.5:8080"},
+			{"user-4", "10.0.0.1:8080"},
+			{"user-5", "10.0.0.2:8080"},
+			{"user-6", "10.0.0.1:8080"},
+			{"user-7", "10.0.0.4:8080"},
+			{"user-8", "10.0.0.5:8080"},
+			{"user-9", "10.0.0.2:8080"},
+			{"user-10", "10.0.0.3:8080"},
+			{"user-11", "10.0.0.4:8080"},
+			{"user-12", "10.0.0.1:8080"},
+			{"user-13", "10.0.0.4:8080"},
+			{"user-14", "10.0.0.2:8080"},
+			{"user-15", "10.0.0.2:8080"},
+			{"user-16", "10.0.0.2:8080"},
+			{"user-17", "10.0.0.5:8080"},
+			{"user-18", "10.0.0.3:8080"},
+			{"user-19", "10.0.0.1:8080"},
+		},
+	},
+	{
+		RingLayoutV2,
+		[]struct{ key, endpoint string }{
+			{"user-0", "10.0.0.4:8080"},
+			{"user-1", "10.0.0.4:8080"},
+			{"user-2", "10.0.0.1:8080"},
+			{"user-3", "10.0.0.2:8080"},
+			{"user-4", "10.0.0.4:8080"},
+			{"user-5", "10.0.0.4:8080"},
+			{"user-6", "10.0.0.3:8080"},
+			{"user-7", "10.0.0.1:8080"},
+			{"user-8", "10.0.0.3:8080"},
+			{"user-9", "10.0.0.1:8080"},
+			{"user-10", "10.0.0.4:8080"},
+			{"user-11", "10.0.0.4:8080"},
+			{"user-12", "10.0.0.1:8080"},
+			{"user-13", "10.0.0.2:8080"},
+			{"user-14", "10.0.0.3:8080"},
+			{"user-15", "10.0.0.4:8080"},
+			{"user-16", "10.0.0.1:8080"},
+			{"user-17", "10.0.0.2:8080"},
+			{"user-18", "10.0.0.1:8080"},
+			{"user-19", "10.0.0.2:8080"},
+		},
+	},
+}
+
+func TestRingLayoutVectors(t *testing.T) {
+	for _, vectors := range ringLayoutVectors {
+		hash := NewConsistent(ConsistentConfig{Layout: vectors.layout})
+		for i := 1; i <= 5; i++ {
+			hash.AddEndpoints(e(fmt.Sprintf("10.0.0.%d:8080", i)))
+		}
+
+		for _, p := range vectors.placement {
+			assert.Equal(t, p.endpoint, hash.Get(p.key).Key(), "layout %d, key %s", vectors.layout, p.key)
+		}
+	}
+}
+
+func TestDefaultRingLayout(t *testing.T) {
+	hash := NewConsistent(ConsistentConfig{})
+	assert.Equal(t, RingLayoutV1, hash.layout)
+}
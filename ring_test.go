@@ -0,0 +1,128 @@
+package balance
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestRing(hashes ...uint64) (*ring, []*endpointInfo) {
+	var nodes []virtualNode
+	var infos []*endpointInfo
+
+	for _, hash := range hashes {
+		info := &endpointInfo{endpoint: e(strconv.FormatUint(hash, 10))}
+		infos = append(infos, info)
+		nodes = append(nodes, virtualNode{hash, info})
+	}
+
+	return emptyRing.add(nodes, len(nodes)), infos
+}
+
+func nodeHashes(r *ring) []uint64 {
+	hashes := []uint64{}
+	for _, node := range r.nodes {
+		hashes = append(hashes, node.hash)
+	}
+	return hashes
+}
+
+func TestRingAdd(t *testing.T) {
+	r, _ := makeTestRing(2, 3, 6)
+	assert.Equal(t, []uint64{2, 3, 6}, nodeHashes(r))
+	assert.Equal(t, 3, r.numEndpoints)
+
+	added, _ := makeTestRing(1, 2, 4)
+	merged := r.add(added.nodes, 1)
+	assert.Equal(t, []uint64{1, 2, 2, 3, 4, 6}, nodeHashes(merged))
+	assert.Equal(t, 4, merged.numEndpoints)
+
+	// Rings are immutable.
+	assert.Equal(t, []uint64{2, 3, 6}, nodeHashes(r))
+
+	assert.Equal(t, []uint64{2, 3, 6}, nodeHashes(r.add(nil, 0)))
+}
+
+func TestRingCollisions(t *testing.T) {
+	a := &endpointInfo{endpoint: e("a")}
+	b := &endpointInfo{endpoint: e("b")}
+
+	// Colliding virtual nodes are ordered by endpoint key, whatever the order
+	// they are added in.
+	r1 := emptyRing.add([]virtualNode{{1, a}}, 1).add([]virtualNode{{1, b}}, 1)
+	r2 := emptyRing.add([]virtualNode{{1, b}}, 1).add([]virtualNode{{1, a}}, 1)
+	assert.Equal(t, r1.nodes, r2.nodes)
+	assert.Equal(t, a, r1.nodes[r1.search(1)].info)
+}
+
+func TestRingRemove(t *testing.T) {
+	r, infos := makeTestRing(1, 2, 3)
+
+	removed := r.remove(map[*endpointInfo]bool{infos[1]: true})
+	assert.Equal(t, []uint64{1, 3}, nodeHashes(removed))
+	assert.Equal(t, 2, removed.numEndpoints)
+
+	// Rings are immutable.
+	assert.Equal(t, []uint64{1, 2, 3}, nodeHashes(r))
+}
+
+func TestRingSearch(t *testing.T) {
+	r, _ := makeTestRing(2, 4, 6)
+
+	assert.Equal(t, 0, r.search(1))
+	assert.Equal(t, 0, r.search(2))
+	assert.Equal(t, 1, r.search(3))
+	// Cycle back to the first node.
+	assert.Equal(t, 0, r.search(7))
+
+	assert.Equal(t, 1, r.next(0))
+	assert.Equal(t, 0, r.next(2))
+}
+
+func TestRingOwnership(t *testing.T) {
+	r, infos := makeTestRing(64, 128, 192)
+
+	// 64 owns the arc wrapping around the end of the 8-bit hash space.
+	owned := r.ownership(8)
+	assert.Equal(t, map[*endpointInfo]float64{
+		infos[0]: 0.5,
+		infos[1]: 0.25,
+		infos[2]: 0.25,
+	}, owned)
+
+	assert.Empty(t, emptyRing.ownership(8))
+
+	single, infos := makeTestRing(42)
+	assert.Equal(t, map[*endpointInfo]float64{infos[0]: 1}, single.ownership(64))
+}
+
+func TestRingRemapped(t *testing.T) {
+	r, infos := makeTestRing(64, 128, 192)
+	added, addedInfos := makeTestRing(96, 224)
+	merged := r.add(added.nodes, 2)
+
+	type move struct {
+		from, to *endpointInfo
+		fraction float64
+	}
+	var moves []move
+	collect := func(from, to *endpointInfo, fraction float64) {
+		moves = append(moves, move{from, to, fraction})
+	}
+
+	// 96 takes (64, 96] from 128, 224 takes (192, 224] from 64.
+	r.remapped(merged, 8, collect)
+	assert.Equal(t, []move{
+		{infos[1], addedInfos[0], 0.125},
+		{infos[0], addedInfos[1], 0.125},
+	}, moves)
+
+	// And the reverse.
+	moves = nil
+	merged.remapped(r, 8, collect)
+	assert.Equal(t, []move{
+		{addedInfos[0], infos[1], 0.125},
+		{addedInfos[1], infos[0], 0.125},
+	}, moves)
+}
@@ -2,6 +2,7 @@ package balance
 
 import (
 	"fmt"
+	"net"
 	"strings"
 )
 
@@ -28,15 +29,41 @@ func validOptionalPort(port string) bool {
 	return true
 }
 
-// splitHostPort splits host and port from "host:port" strings.
+// splitHostPort splits host and port from "host:port", "[host]:port" or
+// "[host]" strings. Brackets are removed from IPv6 hosts. An unbracketed
+// IPv6 address is a host without port.
 func splitHostPort(hostport string) (host, port string) {
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.Index(hostport, "]")
+		if end < 0 {
+			return hostport, ""
+		}
+		host, rest := hostport[1:end], hostport[end+1:]
+		if strings.HasPrefix(rest, ":") {
+			port = rest[1:]
+		}
+		return host, port
+	}
+
 	colon := strings.LastIndex(hostport, ":")
-	if colon < 0 {
+	if colon < 0 || strings.Count(hostport, ":") > 1 {
 		return hostport, ""
 	}
 	return hostport[:colon], hostport[colon+1:]
 }
 
+// joinHostPort combines host and port into an address, omitting the port if
+// empty. IPv6 hosts are bracketed.
+func joinHostPort(host, port string) string {
+	if port == "" {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
 // NewServiceFromString parses the kubernetes Service hostname and port and
 // returns a Service object.
 func NewServiceFromString(s string) (*Service, error) {
@@ -57,9 +84,5 @@ func NewServiceFromString(s string) (*Service, error) {
 }
 
 func (s *Service) String() string {
-	host := s.Name + "." + s.Namespace
-	if s.Port != "" {
-		host += ":" + s.Port
-	}
-	return host
+	return joinHostPort(s.Name+"."+s.Namespace, s.Port)
 }
@@ -6,6 +6,8 @@ type serviceFallback struct {
 }
 
 var _ Algorithm = &serviceFallback{}
+var _ ErrorReporter = &serviceFallback{}
+var _ WeightUpdater = &serviceFallback{}
 
 // WithServiceFallback wraps a load balancer, falling back to the service DNS
 // name when there's no available endpoint to serve the request.
@@ -24,16 +26,45 @@ func (sf *serviceFallback) RemoveEndpoints(endpoints ...Endpoint) {
 	sf.next.RemoveEndpoints(endpoints...)
 }
 
+func (sf *serviceFallback) fallback() Endpoint {
+	address := sf.service.String()
+	return newKubernetesEndpoint(address, EndpointMetadata{Address: address, Ready: true})
+}
+
 func (sf *serviceFallback) Get(key ...string) Endpoint {
 	endpoint := sf.next.Get(key...)
 	if endpoint != nil {
 		return endpoint
 	}
-	return &kubernetesEndpoint{
-		Address: sf.service.Name + "." + sf.service.Namespace + ":" + sf.service.Port,
+	return sf.fallback()
+}
+
+func (sf *serviceFallback) GetExcluding(excluded []Endpoint, key ...string) Endpoint {
+	endpoint := sf.next.GetExcluding(excluded, key...)
+	if endpoint != nil {
+		return endpoint
 	}
+	return sf.fallback()
 }
 
 func (sf *serviceFallback) Put(endpoint Endpoint) {
 	sf.next.Put(endpoint)
 }
+
+func (sf *serviceFallback) ReportError(endpoint Endpoint) {
+	if reporter, ok := sf.next.(ErrorReporter); ok {
+		reporter.ReportError(endpoint)
+	}
+}
+
+func (sf *serviceFallback) UpdateWeights(endpoints ...Endpoint) {
+	if updater, ok := sf.next.(WeightUpdater); ok {
+		updater.UpdateWeights(endpoints...)
+	}
+}
+
+func (sf *serviceFallback) UpdateLabels(endpoints ...Endpoint) {
+	if updater, ok := sf.next.(LabelUpdater); ok {
+		updater.UpdateLabels(endpoints...)
+	}
+}
@@ -16,6 +16,10 @@ func TestSplitHostPort(t *testing.T) {
 		{"localhost:80", "localhost", "80"},
 		{"localhost", "localhost", ""},
 		{"localhost:", "localhost", ""},
+		{"[::1]:80", "::1", "80"},
+		{"[fd00::1]:http", "fd00::1", "http"},
+		{"[fd00::1]", "fd00::1", ""},
+		{"fd00::1", "fd00::1", ""},
 	}
 
 	for _, test := range tests {
@@ -51,3 +55,10 @@ func TestNewServiceFromString(t *testing.T) {
 		assert.Equal(t, test.expected, s)
 	}
 }
+
+func TestJoinHostPort(t *testing.T) {
+	assert.Equal(t, "foo.ns:8080", joinHostPort("foo.ns", "8080"))
+	assert.Equal(t, "foo.ns", joinHostPort("foo.ns", ""))
+	assert.Equal(t, "[fd00::1]:8080", joinHostPort("fd00::1", "8080"))
+	assert.Equal(t, "[fd00::1]", joinHostPort("fd00::1", ""))
+}
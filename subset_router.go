@@ -0,0 +1,300 @@
+package balance
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Subset is a subset of the Service Endpoints selected by labels.
+type Subset struct {
+	// Selector holds the labels an Endpoint must have to be part of the subset.
+	// An empty Selector selects all Endpoints.
+	Selector map[string]string
+
+	// Algorithm load balances requests among the Endpoints of the subset.
+	Algorithm Algorithm
+}
+
+// SubsetRouterConfig holds the configuration of a SubsetRouter.
+type SubsetRouterConfig struct {
+	// Default is the subset used when a request doesn't name a subset, names an
+	// unknown subset or when the named subset has no Endpoint.
+	Default Subset
+
+	// Subsets maps the value of a request attribute, eg. the content of a
+	// X-Version HTTP header, to a subset.
+	Subsets map[string]Subset
+}
+
+// SubsetRouter routes requests to a subset of the Service Endpoints based on a
+// per-request attribute. Each subset has its own inner Algorithm.
+//
+// Endpoints given to a SubsetRouter need to implement Labeled for them to be
+// part of subsets with a non-empty Selector.
+type SubsetRouter struct {
+	sync.Mutex
+	defaultSubset Subset
+	subsets       map[string]Subset
+	// Algorithms of the subsets each Endpoint has been added to, per Endpoint
+	// key. Labels can change after an Endpoint has been added.
+	members map[string][]Algorithm
+}
+
+var _ Algorithm = &SubsetRouter{}
+var _ ErrorReporter = &SubsetRouter{}
+var _ WeightUpdater = &SubsetRouter{}
+var _ LabelUpdater = &SubsetRouter{}
+
+// NewSubsetRouter creates a new SubsetRouter object.
+func NewSubsetRouter(config SubsetRouterConfig) *SubsetRouter {
+	if config.Default.Algorithm == nil {
+		return nil
+	}
+	for _, subset := range config.Subsets {
+		if subset.Algorithm == nil {
+			return nil
+		}
+	}
+	return &SubsetRouter{
+		defaultSubset: config.Default,
+		subsets:       config.Subsets,
+		members:       make(map[string][]Algorithm),
+	}
+}
+
+// matches returns true if endpoint has all the labels of selector.
+func matches(selector map[string]string, endpoint Endpoint) bool {
+	if len(selector) == 0 {
+		return true
+	}
+
+	labeled, ok := endpoint.(Labeled)
+	if !ok {
+		return false
+	}
+
+	labels := labeled.Labels()
+	for k, v := range selector {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *SubsetRouter) forEachSubset(f func(subset Subset)) {
+	f(r.defaultSubset)
+	for _, subset := range r.subsets {
+		f(subset)
+	}
+}
+
+// matchingAlgorithms returns the Algorithms of the subsets endpoint belongs to.
+func (r *SubsetRouter) matchingAlgorithms(endpoint Endpoint) []Algorithm {
+	var algos []Algorithm
+	r.forEachSubset(func(subset Subset) {
+		if matches(subset.Selector, endpoint) && !containsAlgorithm(algos, subset.Algorithm) {
+			algos = append(algos, subset.Algorithm)
+		}
+	})
+	return algos
+}
+
+func containsAlgorithm(algos []Algorithm, algo Algorithm) bool {
+	for _, a := range algos {
+		if a == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointsByAlgorithm groups Endpoints by the Algorithm they are given to.
+type endpointsByAlgorithm map[Algorithm][]Endpoint
+
+// add groups endpoint with the Endpoints of each of algos.
+func (m endpointsByAlgorithm) add(endpoint Endpoint, algos ...Algorithm) {
+	for _, algo := range algos {
+		m[algo] = append(m[algo], endpoint)
+	}
+}
+
+// forEach calls f for each Algorithm, in subset order.
+func (r *SubsetRouter) forEach(m endpointsByAlgorithm, f func(algo Algorithm, endpoints []Endpoint)) {
+	r.forEachSubset(func(subset Subset) {
+		if endpoints, ok := m[subset.Algorithm]; ok {
+			f(subset.Algorithm, endpoints)
+			delete(m, subset.Algorithm)
+		}
+	})
+}
+
+// place moves endpoints to the subsets matching their current labels. It
+// returns the Endpoints to remove from and add to each subset Algorithm.
+func (r *SubsetRouter) place(endpoints []Endpoint) (removed, added endpointsByAlgorithm) {
+	removed, added = make(endpointsByAlgorithm), make(endpointsByAlgorithm)
+
+	r.Lock()
+	defer r.Unlock()
+
+	for _, endpoint := range endpoints {
+		key := endpoint.Key()
+		previous := r.members[key]
+		current := r.matchingAlgorithms(endpoint)
+		for _, algo := range previous {
+			if !containsAlgorithm(current, algo) {
+				removed.add(endpoint, algo)
+			}
+		}
+		for _, algo := range current {
+			if !containsAlgorithm(previous, algo) {
+				added.add(endpoint, algo)
+			}
+		}
+		r.members[key] = current
+	}
+	return removed, added
+}
+
+// AddEndpoints implements EndpointSet. Endpoints already added are moved to
+// the subsets matching their current labels, see UpdateLabels.
+func (r *SubsetRouter) AddEndpoints(endpoints ...Endpoint) {
+	r.UpdateLabels(endpoints...)
+}
+
+// UpdateLabels implements LabelUpdater. Endpoints are removed from the subsets
+// they don't belong to anymore and added to their new subsets.
+func (r *SubsetRouter) UpdateLabels(endpoints ...Endpoint) {
+	removed, added := r.place(endpoints)
+	r.forEach(removed, func(algo Algorithm, endpoints []Endpoint) {
+		algo.RemoveEndpoints(endpoints...)
+	})
+	r.forEach(added, func(algo Algorithm, endpoints []Endpoint) {
+		algo.AddEndpoints(endpoints...)
+	})
+}
+
+// RemoveEndpoints implements EndpointSet. Endpoints are removed from the
+// subsets they have been added to, whatever their current labels.
+func (r *SubsetRouter) RemoveEndpoints(endpoints ...Endpoint) {
+	removed := make(endpointsByAlgorithm)
+
+	r.Lock()
+	for _, endpoint := range endpoints {
+		key := endpoint.Key()
+		removed.add(endpoint, r.members[key]...)
+		delete(r.members, key)
+	}
+	r.Unlock()
+
+	r.forEach(removed, func(algo Algorithm, endpoints []Endpoint) {
+		algo.RemoveEndpoints(endpoints...)
+	})
+}
+
+// subsetEndpoint is an Endpoint returned by the Algorithm of a subset. Put
+// needs to be forwarded to that Algorithm: the same Endpoint can be in flight
+// in several subsets at once.
+type subsetEndpoint struct {
+	Endpoint
+	algo     Algorithm
+	released int32 // atomic
+}
+
+// Address returns the address of the Endpoint, see Address.
+func (e *subsetEndpoint) Address() string {
+	return Address(e.Endpoint)
+}
+
+// Metadata returns the metadata of the Endpoint, empty if it isn't Described.
+func (e *subsetEndpoint) Metadata() EndpointMetadata {
+	if described, ok := e.Endpoint.(Described); ok {
+		return described.Metadata()
+	}
+	return EndpointMetadata{}
+}
+
+var _ Addressed = &subsetEndpoint{}
+var _ Described = &subsetEndpoint{}
+
+func (r *SubsetRouter) get(algo Algorithm, excluded []Endpoint, key ...string) Endpoint {
+	endpoint := algo.GetExcluding(excluded, key...)
+	if endpoint == nil {
+		return nil
+	}
+	return &subsetEndpoint{Endpoint: endpoint, algo: algo}
+}
+
+// Get implements Algorithm. Get uses the default subset.
+func (r *SubsetRouter) Get(key ...string) Endpoint {
+	return r.get(r.defaultSubset.Algorithm, nil, key...)
+}
+
+// GetExcluding implements Algorithm. GetExcluding uses the default subset.
+func (r *SubsetRouter) GetExcluding(excluded []Endpoint, key ...string) Endpoint {
+	return r.get(r.defaultSubset.Algorithm, excluded, key...)
+}
+
+// GetFromSubset returns the Endpoint to use for the next request, choosing
+// among the Endpoints of the named subset. GetFromSubset falls back to the
+// default subset when the subset is unknown or doesn't have any Endpoint.
+//
+// Endpoints returned by a SubsetRouter remember the subset they come from and
+// must be given back as is to Put and ReportError. They implement Addressed and
+// Described on behalf of the Endpoints they stand for.
+//
+// The key argument has the same meaning as in Algorithm.Get.
+func (r *SubsetRouter) GetFromSubset(name string, key ...string) Endpoint {
+	return r.GetFromSubsetExcluding(name, nil, key...)
+}
+
+// GetFromSubsetExcluding is like GetFromSubset but never returns one of the
+// excluded Endpoints. See Algorithm.GetExcluding.
+func (r *SubsetRouter) GetFromSubsetExcluding(name string, excluded []Endpoint, key ...string) Endpoint {
+	if subset, ok := r.subsets[name]; ok {
+		if endpoint := r.get(subset.Algorithm, excluded, key...); endpoint != nil {
+			return endpoint
+		}
+	}
+	return r.GetExcluding(excluded, key...)
+}
+
+// Put implements Algorithm. Put is forwarded to the Algorithm that returned
+// the Endpoint. Endpoints not returned by the SubsetRouter and Endpoints already
+// given back are ignored.
+func (r *SubsetRouter) Put(endpoint Endpoint) {
+	e, ok := endpoint.(*subsetEndpoint)
+	if !ok || !atomic.CompareAndSwapInt32(&e.released, 0, 1) {
+		return
+	}
+	e.algo.Put(e.Endpoint)
+}
+
+// ReportError implements ErrorReporter. The error is forwarded to the
+// Algorithm that returned the Endpoint, if it implements ErrorReporter.
+func (r *SubsetRouter) ReportError(endpoint Endpoint) {
+	e, ok := endpoint.(*subsetEndpoint)
+	if !ok {
+		return
+	}
+	if reporter, ok := e.algo.(ErrorReporter); ok {
+		reporter.ReportError(e.Endpoint)
+	}
+}
+
+// UpdateWeights implements WeightUpdater. Weight updates are forwarded to the
+// subsets of the Endpoints whose Algorithm implements WeightUpdater.
+func (r *SubsetRouter) UpdateWeights(endpoints ...Endpoint) {
+	updated := make(endpointsByAlgorithm)
+	r.Lock()
+	for _, endpoint := range endpoints {
+		updated.add(endpoint, r.members[endpoint.Key()]...)
+	}
+	r.Unlock()
+
+	r.forEach(updated, func(algo Algorithm, endpoints []Endpoint) {
+		if updater, ok := algo.(WeightUpdater); ok {
+			updater.UpdateWeights(endpoints...)
+		}
+	})
+}
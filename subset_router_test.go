@@ -0,0 +1,157 @@
+package balance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// le is a labeled dummy Endpoint for testing.
+type le struct {
+	key    string
+	labels map[string]string
+}
+
+func (e *le) Key() string               { return e.key }
+func (e *le) Labels() map[string]string { return e.labels }
+
+func version(key, v string) *le {
+	return &le{key: key, labels: map[string]string{"version": v}}
+}
+
+func makeTestRouter() *SubsetRouter {
+	newConsistent := func() Algorithm {
+		return NewConsistent(ConsistentConfig{
+			ReplicationCount: 3,
+			Hash:             testHash,
+			LoadFactor:       1.25,
+		})
+	}
+
+	return NewSubsetRouter(SubsetRouterConfig{
+		Default: Subset{
+			Selector:  map[string]string{"version": "v1"},
+			Algorithm: newConsistent(),
+		},
+		Subsets: map[string]Subset{
+			"v2": {
+				Selector:  map[string]string{"version": "v2"},
+				Algorithm: newConsistent(),
+			},
+			"v3": {
+				Selector:  map[string]string{"version": "v3"},
+				Algorithm: newConsistent(),
+			},
+		},
+	})
+}
+
+func TestSubsetRouter(t *testing.T) {
+	router := makeTestRouter()
+	router.AddEndpoints(version("2", "v1"), version("4", "v1"), version("6", "v2"))
+
+	// Default subset.
+	assert.Equal(t, "2", router.Get("11").Key())
+	assert.Equal(t, "4", router.GetFromSubset("v1", "13").Key())
+	// v2 subset only has 6.
+	assert.Equal(t, "6", router.GetFromSubset("v2", "11").Key())
+	// v3 subset is empty, fall back to the default subset.
+	assert.Equal(t, "2", router.GetFromSubset("v3", "11").Key())
+
+	router.RemoveEndpoints(version("6", "v2"))
+	assert.Equal(t, "2", router.GetFromSubset("v2", "11").Key())
+}
+
+func TestSubsetRouterPut(t *testing.T) {
+	router := makeTestRouter()
+	v1 := router.defaultSubset.Algorithm.(*Consistent)
+	v2 := router.subsets["v2"].Algorithm.(*Consistent)
+
+	router.AddEndpoints(version("2", "v1"), version("6", "v2"))
+
+	endpoint1 := router.Get("1")
+	endpoint2 := router.GetFromSubset("v2", "1")
+	assert.EqualValues(t, 1, v1.totalLoad)
+	assert.EqualValues(t, 1, v2.totalLoad)
+
+	// Put must reach the Algorithm that returned the Endpoint.
+	router.Put(endpoint2)
+	assert.EqualValues(t, 1, v1.totalLoad)
+	assert.EqualValues(t, 0, v2.totalLoad)
+	router.Put(endpoint1)
+	assert.EqualValues(t, 0, v1.totalLoad)
+
+	// Unbalanced Put are ignored.
+	router.Put(endpoint1)
+	assert.EqualValues(t, 0, v1.totalLoad)
+}
+
+func TestSubsetRouterSharedEndpoint(t *testing.T) {
+	v1 := NewConsistent(ConsistentConfig{LoadFactor: 1.25})
+	v2 := NewConsistent(ConsistentConfig{LoadFactor: 1.25})
+	router := NewSubsetRouter(SubsetRouterConfig{
+		Default: Subset{Algorithm: v1},
+		Subsets: map[string]Subset{
+			"v2": {
+				Selector:  map[string]string{"version": "v2"},
+				Algorithm: v2,
+			},
+		},
+	})
+
+	// The Endpoint is part of both subsets.
+	router.AddEndpoints(version("a", "v2"))
+	fromV2 := router.GetFromSubset("v2", "foo")
+	fromV1 := router.Get("foo")
+	assert.Equal(t, "a", fromV2.Key())
+	assert.Equal(t, "a", fromV1.Key())
+	assert.Equal(t, "a", Address(fromV2))
+
+	// Put reaches the subset the Endpoint was returned from, whatever the
+	// order requests complete in.
+	router.Put(fromV2)
+	assert.EqualValues(t, 1, v1.totalLoad)
+	assert.EqualValues(t, 0, v2.totalLoad)
+	router.Put(fromV1)
+	assert.EqualValues(t, 0, v1.totalLoad)
+}
+
+func TestSubsetRouterUnlabeled(t *testing.T) {
+	router := NewSubsetRouter(SubsetRouterConfig{
+		Default: Subset{
+			Algorithm: NewConsistent(ConsistentConfig{}),
+		},
+		Subsets: map[string]Subset{
+			"v2": {
+				Selector:  map[string]string{"version": "v2"},
+				Algorithm: NewConsistent(ConsistentConfig{}),
+			},
+		},
+	})
+
+	// Endpoints without labels only end up in subsets with an empty selector.
+	router.AddEndpoints(e("a"))
+	assert.Equal(t, "a", router.GetFromSubset("v2", "foo").Key())
+	assert.Nil(t, router.subsets["v2"].Algorithm.Get("foo"))
+}
+
+func TestSubsetRouterRelabel(t *testing.T) {
+	router := makeTestRouter()
+	v1 := router.defaultSubset.Algorithm.(*Consistent)
+	v2 := router.subsets["v2"].Algorithm.(*Consistent)
+
+	endpoint := version("2", "v1")
+	router.AddEndpoints(endpoint)
+
+	// The Endpoint moves to v2 when told about the new labels.
+	endpoint.labels = map[string]string{"version": "v2"}
+	router.UpdateLabels(endpoint)
+	assert.Equal(t, 0, v1.numEndpoints)
+	assert.Equal(t, 1, v2.numEndpoints)
+
+	// Endpoints are removed from the subsets they were added to, even when
+	// their labels have changed since.
+	endpoint.labels = map[string]string{"version": "v3"}
+	router.RemoveEndpoints(endpoint)
+	assert.Equal(t, 0, v2.numEndpoints)
+}
@@ -3,11 +3,68 @@ package balance
 // Hash is a 32-bit hash function.
 type Hash func(data []byte) uint32
 
+// Hash64 is a 64-bit hash function.
+type Hash64 func(data []byte) uint64
+
 // Endpoint is service endpoint.
 type Endpoint interface {
 	Key() string
 }
 
+// Addressed is implemented by Endpoints whose address isn't their key, eg.
+// Endpoints keyed by pod name. See Address.
+type Addressed interface {
+	Address() string
+}
+
+// Labeled is implemented by Endpoints carrying labels, eg. the labels of the
+// Kubernetes pod behind the Endpoint.
+type Labeled interface {
+	Labels() map[string]string
+}
+
+// LabelUpdater is implemented by EndpointSets placing Endpoints according to
+// their labels. UpdateLabels is called with Endpoints already part of the set
+// when their labels change.
+type LabelUpdater interface {
+	UpdateLabels(endpoints ...Endpoint)
+}
+
+// Described is implemented by Endpoints carrying metadata about the Kubernetes
+// object behind them, eg. for logging or tracing.
+type Described interface {
+	Metadata() EndpointMetadata
+}
+
+// Readiness is implemented by Endpoints that can be not ready to serve
+// requests while staying known to the load balancer, eg. pods failing their
+// readiness probe.
+type Readiness interface {
+	Ready() bool
+}
+
+const (
+	// DefaultWeight is the weight of Endpoints that don't implement Weighted.
+	DefaultWeight = 100
+	// MaxWeight is the maximum weight of an Endpoint. Larger weights are
+	// clamped to MaxWeight, bounding the number of virtual nodes of an
+	// Endpoint to 10 times the replication count.
+	MaxWeight = 10 * DefaultWeight
+)
+
+// Weighted is implemented by Endpoints with a weight. With weight-aware
+// Algorithms, an Endpoint receives a share of requests proportional to its
+// weight, between 1 and MaxWeight. See DefaultWeight.
+type Weighted interface {
+	Weight() int
+}
+
+// WeightUpdater is implemented by weight-aware EndpointSets. UpdateWeights is
+// called with Endpoints already part of the set when their weight changes.
+type WeightUpdater interface {
+	UpdateWeights(endpoints ...Endpoint)
+}
+
 // EndpointSet holds a set of Endpoints.
 type EndpointSet interface {
 	AddEndpoints(...Endpoint)
@@ -31,6 +88,20 @@ type Algorithm interface {
 	// Get may return nil when the load balancer is not aware of any
 	// Endpoint.
 	Get(key ...string) Endpoint
+	// GetExcluding is like Get but never returns one of the excluded Endpoints.
+	// It's useful to retry a failed request on a different Endpoint: with
+	// affinity load balancing schemes, GetExcluding returns the next best
+	// Endpoint for the key.
+	//
+	// GetExcluding may return nil when all known Endpoints are excluded.
+	GetExcluding(excluded []Endpoint, key ...string) Endpoint
 	// Put releases the Endpoint when it has finished processing the request.
 	Put(endpoint Endpoint)
 }
+
+// ErrorReporter is implemented by Algorithms keeping track of failed requests.
+type ErrorReporter interface {
+	// ReportError records that a request sent to endpoint failed. It's called
+	// before the Endpoint is released with Put.
+	ReportError(endpoint Endpoint)
+}
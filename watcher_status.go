@@ -0,0 +1,184 @@
+package balance
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	defaultRetryInitial = time.Second
+	defaultRetryMax     = time.Minute
+	retryJitter         = 0.5
+)
+
+// WatcherStatus is the state of the connection of a watcher to the Kubernetes
+// API server.
+type WatcherStatus struct {
+	// Connected is true when the last request to the API server succeeded.
+	Connected bool
+	// Synced is true once the initial list of Endpoints has been received, see
+	// EndpointWatcher.HasSynced.
+	Synced bool
+	// LastError is the last error encountered talking to the API server, nil if
+	// none.
+	LastError error
+	// LastErrorTime is when LastError happened.
+	LastErrorTime time.Time
+	// ConsecutiveErrors is the number of requests that failed since the last
+	// successful one.
+	ConsecutiveErrors int
+}
+
+// Healthy returns true when the watcher has received the Endpoints and is
+// following their changes.
+func (s WatcherStatus) Healthy() bool {
+	return s.Connected && s.Synced
+}
+
+// watcherStatus tracks the outcome of the requests of the watcher and
+// computes the delay before retrying failed ones.
+type watcherStatus struct {
+	sync.Mutex
+	status WatcherStatus
+}
+
+// succeeded records a successful request.
+func (s *watcherStatus) succeeded() {
+	s.Lock()
+	s.status.Connected = true
+	s.status.ConsecutiveErrors = 0
+	s.Unlock()
+}
+
+// failed records a failed request.
+func (s *watcherStatus) failed(err error) {
+	s.Lock()
+	s.status.Connected = false
+	s.status.LastError = err
+	s.status.LastErrorTime = time.Now()
+	s.status.ConsecutiveErrors++
+	s.Unlock()
+}
+
+// get returns the current status.
+func (s *watcherStatus) get() WatcherStatus {
+	s.Lock()
+	defer s.Unlock()
+	return s.status
+}
+
+// retryDelay returns how long to wait before retrying a request: nothing if
+// the last one succeeded, an exponentially increasing and jittered delay when
+// requests keep failing.
+func (s *watcherStatus) retryDelay(initial, max time.Duration) time.Duration {
+	s.Lock()
+	failures := s.status.ConsecutiveErrors
+	s.Unlock()
+
+	if failures == 0 {
+		return 0
+	}
+	delay := float64(initial) * math.Pow(2, float64(failures-1))
+	if delay > float64(max) {
+		delay = float64(max)
+	}
+	return wait.Jitter(time.Duration(delay), retryJitter)
+}
+
+// reportError records a failed request to the API server and hands err to the
+// OnError callback.
+func (w *EndpointWatcher) reportError(status *watcherStatus, err error) {
+	status.failed(err)
+	log.Errorf("watcher: %s/%s: %v", w.Service.Namespace, w.Service.Name, err)
+	if w.OnError != nil {
+		w.OnError(err)
+	}
+}
+
+// backoff waits before retrying a failed request to the API server. It returns
+// false if stop is closed first.
+func (w *EndpointWatcher) backoff(status *watcherStatus, stop <-chan struct{}) bool {
+	initial, max := w.RetryInitial, w.RetryMax
+	if initial == 0 {
+		initial = defaultRetryInitial
+	}
+	if max == 0 {
+		max = defaultRetryMax
+	}
+
+	delay := status.retryDelay(initial, max)
+	if delay == 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// listWatch wraps the list and watch requests of an informer. Failed requests
+// are reported and delay the next request, backing off exponentially, the
+// informer retrying them.
+func (w *EndpointWatcher) listWatch(status *watcherStatus, stop <-chan struct{},
+	list func(metav1.ListOptions) (runtime.Object, error),
+	watchFunc func(metav1.ListOptions) (watch.Interface, error)) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			if !w.backoff(status, stop) {
+				return nil, errWatcherStopped
+			}
+			obj, err := list(options)
+			if err != nil {
+				w.reportError(status, err)
+				return nil, err
+			}
+			status.succeeded()
+			return obj, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			if !w.backoff(status, stop) {
+				return nil, errWatcherStopped
+			}
+			events, err := watchFunc(options)
+			if err != nil {
+				w.reportError(status, err)
+				return nil, err
+			}
+			status.succeeded()
+			return events, nil
+		},
+	}
+}
+
+// Status returns the state of the connection to the API server. When pods are
+// watched, the state covers both the Endpoints and pod watches.
+func (w *EndpointWatcher) Status() WatcherStatus {
+	status := w.status.get()
+	w.Lock()
+	watchingPods := w.podInformer != nil
+	w.Unlock()
+
+	if watchingPods {
+		pods := w.podStatus.get()
+		status.Connected = status.Connected && pods.Connected
+		status.ConsecutiveErrors += pods.ConsecutiveErrors
+		if pods.LastErrorTime.After(status.LastErrorTime) {
+			status.LastError, status.LastErrorTime = pods.LastError, pods.LastErrorTime
+		}
+	}
+	status.Synced = w.HasSynced()
+	return status
+}
@@ -0,0 +1,135 @@
+package balance
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func TestRetryDelay(t *testing.T) {
+	var s watcherStatus
+	assert.Equal(t, time.Duration(0), s.retryDelay(time.Second, time.Minute))
+
+	// Delays double, up to the maximum, with up to 50% of jitter.
+	for i, expected := range []time.Duration{1, 2, 4, 8, 16, 32, 60, 60} {
+		s.failed(errors.New("unavailable"))
+		delay := s.retryDelay(time.Second, time.Minute)
+		assert.True(t, delay >= expected*time.Second && delay <= expected*time.Second*3/2,
+			"failure %d: %v", i+1, delay)
+	}
+
+	s.succeeded()
+	assert.Equal(t, time.Duration(0), s.retryDelay(time.Second, time.Minute))
+}
+
+func TestWatcherErrors(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []corev1.EndpointPort{{Port: 8080}},
+		}},
+	})
+	// The first list fails.
+	var lists int32
+	client.PrependReactor("list", "endpoints", func(ktesting.Action) (bool, runtime.Object, error) {
+		if atomic.AddInt32(&lists, 1) == 1 {
+			return true, nil, errors.New("unavailable")
+		}
+		return false, nil, nil
+	})
+
+	var reported int32
+	r := &recorder{endpoints: make(map[string]Endpoint)}
+	w := &EndpointWatcher{
+		Client:       client,
+		Service:      Service{Namespace: "default", Name: "db", Port: "8080"},
+		Receiver:     r,
+		RetryInitial: 10 * time.Millisecond,
+		OnError: func(err error) {
+			atomic.AddInt32(&reported, 1)
+		},
+	}
+	assert.False(t, w.Status().Healthy())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		w.Wait()
+	}()
+	w.Start(ctx)
+
+	// The error is reported and the watcher recovers.
+	assert.True(t, waitFor(w.HasSynced))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reported))
+	status := w.Status()
+	assert.True(t, status.Healthy())
+	assert.EqualError(t, status.LastError, "unavailable")
+	assert.Equal(t, 0, status.ConsecutiveErrors)
+}
+
+func TestWatcherPodErrors(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		dbService(),
+		&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Subsets:    statefulSubset("10.0.0.1"),
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "db-2",
+				Labels:      map[string]string{"app": "db"},
+				Annotations: map[string]string{WeightAnnotation: "50"},
+			},
+		},
+	)
+	// Listing pods fails until unblocked.
+	var unavailable int32 = 1
+	client.PrependReactor("list", "pods", func(ktesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&unavailable) == 1 {
+			return true, nil, errors.New("unavailable")
+		}
+		return false, nil, nil
+	})
+
+	r := &recorder{endpoints: make(map[string]Endpoint)}
+	w := &EndpointWatcher{
+		Client:       client,
+		Service:      Service{Namespace: "default", Name: "db", Port: "8080"},
+		Receiver:     r,
+		Weights:      WeightFromAnnotation,
+		RetryInitial: 10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		w.Wait()
+	}()
+	// Start doesn't block on the pod list.
+	w.Start(ctx)
+
+	assert.True(t, waitFor(func() bool { return w.Status().LastError != nil }))
+	status := w.Status()
+	assert.False(t, status.Healthy())
+	assert.False(t, status.Synced)
+	assert.EqualError(t, status.LastError, "unavailable")
+
+	// Endpoints are given once the pods are known, with their weight.
+	atomic.StoreInt32(&unavailable, 0)
+	assert.True(t, waitFor(w.HasSynced))
+	assert.True(t, w.Status().Healthy())
+	w.Lock()
+	assert.Equal(t, 50, r.endpoints["10.0.0.1:8080"].(Weighted).Weight())
+	w.Unlock()
+}
@@ -0,0 +1,74 @@
+package balance
+
+import (
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// WeightAnnotation is the pod annotation holding the weight of the Endpoints of
+// a pod, see WeightFromAnnotation.
+const WeightAnnotation = "balance.io/weight"
+
+// WeightSource selects where the watcher reads Endpoint weights from.
+type WeightSource int
+
+const (
+	// WeightNone doesn't give Endpoints a weight.
+	WeightNone WeightSource = iota
+	// WeightFromAnnotation reads the weight of Endpoints from the
+	// WeightAnnotation annotation of their pod. Pods without a valid weight
+	// annotation have DefaultWeight. Weights above MaxWeight are clamped.
+	WeightFromAnnotation
+	// WeightFromCPURequests derives the weight of Endpoints from the CPU
+	// requests of their pod: one CPU is worth DefaultWeight. Pods without CPU
+	// requests have DefaultWeight. Weights above MaxWeight are clamped.
+	WeightFromCPURequests
+)
+
+// clampWeight brings weight between 1 and MaxWeight.
+func clampWeight(weight int) int {
+	switch {
+	case weight < 1:
+		return 1
+	case weight > MaxWeight:
+		return MaxWeight
+	default:
+		return weight
+	}
+}
+
+// podWeight returns the weight of the Endpoints of pod.
+func podWeight(pod *corev1.Pod, source WeightSource) int {
+	switch source {
+	case WeightFromAnnotation:
+		value, ok := pod.Annotations[WeightAnnotation]
+		if !ok {
+			return DefaultWeight
+		}
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 1 {
+			log.Errorf("watcher: invalid weight for pod %s/%s: %q", pod.Namespace, pod.Name, value)
+			return DefaultWeight
+		}
+		return clampWeight(weight)
+	case WeightFromCPURequests:
+		var millis int64
+		for _, container := range pod.Spec.Containers {
+			if cpu, ok := container.Resources.Requests[corev1.ResourceCPU]; ok {
+				millis += cpu.MilliValue()
+			}
+		}
+		if millis == 0 {
+			return DefaultWeight
+		}
+		if millis > MaxWeight*1000/DefaultWeight {
+			return MaxWeight
+		}
+		return clampWeight(int(millis * DefaultWeight / 1000))
+	default:
+		return DefaultWeight
+	}
+}
@@ -0,0 +1,96 @@
+package balance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func annotatedPod(weight string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pod",
+			Annotations: map[string]string{WeightAnnotation: weight},
+		},
+	}
+}
+
+func cpuPod(requests ...string) *corev1.Pod {
+	pod := &corev1.Pod{}
+	for _, request := range requests {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU: resource.MustParse(request),
+				},
+			},
+		})
+	}
+	return pod
+}
+
+func TestPodWeight(t *testing.T) {
+	tests := []struct {
+		pod      *corev1.Pod
+		source   WeightSource
+		expected int
+	}{
+		{annotatedPod("50"), WeightNone, DefaultWeight},
+		{annotatedPod("50"), WeightFromAnnotation, 50},
+		{annotatedPod("foo"), WeightFromAnnotation, DefaultWeight},
+		{annotatedPod("0"), WeightFromAnnotation, DefaultWeight},
+		{annotatedPod("1000000"), WeightFromAnnotation, MaxWeight},
+		{annotatedPod("9223372036854775807"), WeightFromAnnotation, MaxWeight},
+		{&corev1.Pod{}, WeightFromAnnotation, DefaultWeight},
+		{cpuPod("2"), WeightFromCPURequests, 2 * DefaultWeight},
+		{cpuPod("250m", "250m"), WeightFromCPURequests, DefaultWeight / 2},
+		{cpuPod("1m"), WeightFromCPURequests, 1},
+		{cpuPod("64"), WeightFromCPURequests, MaxWeight},
+		{cpuPod(), WeightFromCPURequests, DefaultWeight},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, podWeight(test.pod, test.source))
+	}
+}
+
+// updateRecorder is a recorder recording weight updates.
+type updateRecorder struct {
+	recorder
+	updated []string
+}
+
+func (r *updateRecorder) UpdateWeights(endpoints ...Endpoint) {
+	r.updated = append(r.updated, keys(endpoints)...)
+}
+
+func TestWatcherWeights(t *testing.T) {
+	r := &updateRecorder{recorder: recorder{endpoints: make(map[string]Endpoint)}}
+	w := &EndpointWatcher{
+		Client: fake.NewSimpleClientset(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db-2"},
+		}),
+		Service:  Service{Namespace: "default", Name: "db", Port: "8080"},
+		Receiver: r,
+		Weights:  WeightFromAnnotation,
+	}
+
+	w.setEndpoints(w.makeEndpoints(statefulSubset("10.0.0.1")))
+	endpoint := r.endpoints["10.0.0.1:8080"]
+	assert.Equal(t, DefaultWeight, endpoint.(Weighted).Weight())
+
+	// The pod annotation changes.
+	pod := annotatedPod("200")
+	pod.Name = "db-2"
+	w.podUpdated(pod)
+	assert.Equal(t, 200, endpoint.(Weighted).Weight())
+	assert.Equal(t, []string{"10.0.0.1:8080"}, r.updated)
+
+	// No change, no update.
+	w.podUpdated(pod)
+	assert.Equal(t, []string{"10.0.0.1:8080"}, r.updated)
+}